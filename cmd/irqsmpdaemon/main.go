@@ -18,29 +18,56 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pperiyasamy/irq-smp-balance/pkg/irq"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	defaultPodIrqBannedCPUsFile = "/etc/sysconfig/pod_irq_banned_cpus"
-	defaultIrqBalanceConfigFile = "/etc/sysconfig/irqbalance"
 	irqSmpAffinityFile          = "/proc/irq/default_smp_affinity"
+	irqProcDir                  = "/proc/irq"
+	procDir                     = "/proc"
+	sysCPUDir                   = "/sys/devices/system/cpu"
+	irqSmpBalanceStateDir       = "/var/lib/irq-smp-balance"
+	cpuOwnershipLedgerFile      = irqSmpBalanceStateDir + "/cpu_ownership_ledger"
+	irqAffinitySnapshotFile     = irqSmpBalanceStateDir + "/irq_affinity_snapshot"
+	interruptsFile              = "/proc/interrupts"
 	defaultLogFile              = "/var/log/irqsmpdaemon.log"
+	defaultDriftInterval        = time.Minute
+	defaultMetricsAddress       = "127.0.0.1:9091"
+
+	backendIRQBalance = "irqbalance"
+	backendBuiltin    = "builtin"
 )
 
 func main() {
 	podIrqBannedCPUsFile := flag.String("podfile", defaultPodIrqBannedCPUsFile, "pod irq banned cpus file")
-	irqBalanceConfigFile := flag.String("config", defaultIrqBalanceConfigFile, "irq balance config file")
+	irqBalanceConfigFile := flag.String("config", "", "irq balance config file (default detected from "+
+		irq.SysconfigIrqBalanceConfigFile+" or "+irq.DefaultIrqBalanceConfigFile+")")
 	logFile := flag.String("log", defaultLogFile, "log file")
+	driftModeName := flag.String("drift-mode", string(irq.DriftModeReport), "what to do when irqbalance banned cpus drift from the desired state: off, report or repair")
+	driftInterval := flag.Duration("drift-interval", defaultDriftInterval, "irqbalance banned cpus drift verification interval")
+	restartPolicy := flag.String("restart-policy", irq.DefaultIRQBalanceRestartPolicy, "comma separated irqbalance restart methods tried in order when there is no irqbalance control socket: dbus, service or oneshot")
+	backend := flag.String("backend", backendIRQBalance, "what keeps irqs off the banned cpus: irqbalance, or builtin for hosts without irqbalance")
+	hotplugInterval := flag.Duration("hotplug-interval", irq.DefaultHotplugInterval, "online cpus polling interval")
+	balanceInterval := flag.Duration("balance-interval", irq.DefaultBalanceInterval, "rebalance interval of the builtin backend")
+	restartTimeout := flag.Duration("restart-timeout", irq.DefaultIRQBalanceRestartTimeout, "time given to each irqbalance restart method")
+	metricsAddress := flag.String("metrics-address", defaultMetricsAddress, "address to serve prometheus metrics on, empty disables the metrics")
 	flag.Parse()
+	// daemon runs on the host, the threaded irq handlers are in the host proc and
+	// the cpu topology is in the host sysfs
+	irq.IRQThreadProcDir = procDir
+	irq.CPUTopologyDir = sysCPUDir
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM,
@@ -51,6 +78,15 @@ func main() {
 		panic(err)
 	}
 
+	driftMode, err := irq.ParseDriftMode(*driftModeName)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	restartMethods, err := irq.ParseRestartPolicy(*restartPolicy)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		logrus.Fatal(err)
@@ -62,6 +98,46 @@ func main() {
 	}()
 
 	logrus.Infof("using config file %s", *podIrqBannedCPUsFile)
+	metrics.Serve(*metricsAddress)
+
+	irqBalanceConfig := irq.DetectIRQBalanceConfig(*irqBalanceConfigFile)
+	irqBalanceConfig.RestartPolicy = restartMethods
+	irqBalanceConfig.RestartTimeout = *restartTimeout
+
+	stop := make(chan struct{})
+	var setBannedCPUs func(bannedCPUMask string) error
+	// device irqs pinned to the pod cpus are on banned cpus, irqbalance must leave them
+	// alone. the builtin backend does so already.
+	banPinnedIRQs := func() {}
+	switch *backend {
+	case backendIRQBalance:
+		setBannedCPUs = func(bannedCPUMask string) error {
+			err := irq.ResetIRQBalance(irqBalanceConfig, bannedCPUMask)
+			if err != nil {
+				metrics.IRQBalanceResetFailures.Inc()
+			}
+			return err
+		}
+		banPinnedIRQs = func() {
+			if err := banIRQs(irq.NewIRQBalanceSocket(irqBalanceConfig.SocketDir)); err != nil {
+				logrus.Errorf("error banning pinned device irqs in irqbalance: %v", err)
+			}
+		}
+	case backendBuiltin:
+		balancer := irq.NewBalancer(irqProcDir, interruptsFile, *balanceInterval)
+		go balancer.Run(stop)
+		setBannedCPUs = balancer.SetBannedCPUs
+	default:
+		logrus.Fatalf("invalid backend %s, must be one of %s or %s", *backend, backendIRQBalance, backendBuiltin)
+	}
+	logrus.Infof("using %s backend", *backend)
+
+	// cpus banned by administrator must stay banned whatever pods come and go
+	staticBannedCPUs, err := initializeStaticBannedCPUs(irqBalanceConfig)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("static banned cpus %s", staticBannedCPUs)
 
 	go func() {
 		for {
@@ -70,15 +146,25 @@ func main() {
 				if !ok {
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
+				if event.Name == irqAffinitySnapshotFile {
+					// snapshots are replaced by rename, which is a create event
+					if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+						banPinnedIRQs()
+					}
+					continue
+				}
+				if event.Name == *podIrqBannedCPUsFile && event.Op&fsnotify.Write == fsnotify.Write {
 					content, err := ioutil.ReadFile(*podIrqBannedCPUsFile)
 					if err != nil {
 						logrus.Infof("error reading %s file : %v", *podIrqBannedCPUsFile, err)
 						return
 					}
-					if err = irq.ResetIRQBalance(*irqBalanceConfigFile, strings.TrimSpace(string(content))); err != nil {
+					err = applyBannedCPUs(setBannedCPUs, staticBannedCPUs, strings.TrimSpace(string(content)))
+					if err != nil {
 						logrus.Infof("irqbalance with banned cpus failed: %v", err)
 					}
+					// a restarted irqbalance has forgotten the banned irqs
+					banPinnedIRQs()
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
@@ -89,12 +175,50 @@ func main() {
 		}
 	}()
 
-	if err = initializeConfigFile(*podIrqBannedCPUsFile, *irqBalanceConfigFile); err != nil {
+	if err = initializeConfigFile(*podIrqBannedCPUsFile, setBannedCPUs, staticBannedCPUs); err != nil {
 		logrus.Fatal(err)
 	}
 	if err = watcher.Add(*podIrqBannedCPUsFile); err != nil {
 		logrus.Fatal(err)
 	}
+	if err = os.MkdirAll(irqSmpBalanceStateDir, 0o755); err != nil {
+		logrus.Fatal(err)
+	}
+	if err = watcher.Add(irqSmpBalanceStateDir); err != nil {
+		logrus.Fatal(err)
+	}
+	banPinnedIRQs()
+
+	// tuned or an operator may rewrite irqbalance config behind our back
+	if *backend == backendIRQBalance {
+		verifier := irq.NewDriftVerifier(driftMode, *driftInterval, nil,
+			irq.NewIRQBalanceConfigDriftCheck(irqBalanceConfig, func() (string, error) {
+				podBannedCPUs, err := desiredBannedCPUs(*podIrqBannedCPUsFile)
+				if err != nil {
+					return "", err
+				}
+				return irq.MergeBannedCPUs(staticBannedCPUs, podBannedCPUs)
+			}))
+		go verifier.Run(stop)
+	}
+
+	// irqbalance must not keep offline cpus banned nor miss cpus coming online
+	hotplug, err := irq.NewHotplugWatcher(sysCPUDir, *hotplugInterval, func(irq.CPUHotplugEvent) {
+		podBannedCPUs, err := desiredBannedCPUs(*podIrqBannedCPUsFile)
+		if err != nil {
+			logrus.Errorf("hotplug: error retrieving pod banned cpus: %v", err)
+			return
+		}
+		if err := applyBannedCPUs(setBannedCPUs, staticBannedCPUs, podBannedCPUs); err != nil {
+			logrus.Errorf("hotplug: applying banned cpus failed: %v", err)
+			return
+		}
+		logrus.Infof("hotplug: banned cpus are applied to %s backend", *backend)
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	go hotplug.Run(stop)
 
 	go func() {
 		sig := <-sigs
@@ -104,6 +228,7 @@ func main() {
 
 	// Capture signals to cleanup before exiting
 	<-done
+	close(stop)
 
 	logrus.Infof("irq smp daemon is stopped")
 }
@@ -117,7 +242,69 @@ func initializeLog(logFile string) error {
 	return nil
 }
 
-func initializeConfigFile(podIrqBannedCPUsFile, irqBalanceConfigFile string) error {
+// desiredBannedCPUs returns the banned cpus written by smpaffinity, derived from
+// irqSmpAffinityFile when nothing is written yet.
+func desiredBannedCPUs(podIrqBannedCPUsFile string) (string, error) {
+	content, err := ioutil.ReadFile(podIrqBannedCPUsFile)
+	if err != nil {
+		return "", err
+	}
+	if bannedCPUMask := strings.TrimSpace(string(content)); bannedCPUMask != "" {
+		return bannedCPUMask, nil
+	}
+	return bannedCPUsFromSmpAffinity()
+}
+
+// bannedCPUsFromSmpAffinity derives the banned cpu mask from irqSmpAffinityFile
+func bannedCPUsFromSmpAffinity() (string, error) {
+	cpuMask, err := irq.RetrieveCPUMask(irqSmpAffinityFile)
+	if err != nil {
+		return "", err
+	}
+	return irq.InvertMaskStringWithComma(cpuMask)
+}
+
+// initializeStaticBannedCPUs returns cpus banned by administrator. At first start
+// those are the cpus banned in irqbalance config but not isolated for the pods in the
+// cpu ownership ledger of smpaffinity.
+func initializeStaticBannedCPUs(irqBalanceConfig irq.IRQBalanceConfig) (string, error) {
+	podIsolatedCPUs, err := irq.ReadLedgerIsolatedCPUs(cpuOwnershipLedgerFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading pod isolated cpus: %v", err)
+	}
+	return irq.InitializeStaticBannedCPUs(irqBalanceConfig, podIsolatedCPUs)
+}
+
+// banIRQs makes irqbalance leave the device irqs pinned to the pod cpus alone, which
+// is only possible through irqbalance control socket.
+func banIRQs(socket *irq.IRQBalanceSocket) error {
+	irqs, err := irq.ReadPinnedIRQs(irqAffinitySnapshotFile)
+	if err != nil {
+		return err
+	}
+	err = socket.SetBannedIRQs(irqs)
+	if err == irq.ErrIRQBalanceSocketNotFound {
+		if len(irqs) > 0 {
+			logrus.Warnf("no irqbalance control socket, irqbalance may move pinned device irqs %v off the pod cpus", irqs)
+		}
+		return nil
+	}
+	return err
+}
+
+// applyBannedCPUs hands the union of static and pod banned cpus to the backend
+func applyBannedCPUs(setBannedCPUs func(string) error, staticBannedCPUs, podBannedCPUs string) error {
+	bannedCPUs, err := irq.MergeBannedCPUs(staticBannedCPUs, podBannedCPUs)
+	if err != nil {
+		return err
+	}
+	if podmask, err := irq.ParseCPUMask(podBannedCPUs); err == nil {
+		metrics.IsolatedCPUs.Set(float64(podmask.CPUSet().Size()))
+	}
+	return setBannedCPUs(bannedCPUs)
+}
+
+func initializeConfigFile(podIrqBannedCPUsFile string, setBannedCPUs func(string) error, staticBannedCPUs string) error {
 	_, err := os.Stat(podIrqBannedCPUsFile)
 	if os.IsNotExist(err) {
 		irqBalanceConfig, err := os.Create(podIrqBannedCPUsFile)
@@ -133,16 +320,11 @@ func initializeConfigFile(podIrqBannedCPUsFile, irqBalanceConfigFile string) err
 		// this would fix the recovery of irqbalance config after
 		// compute reboot
 		var bannedCPUMask string
-		if cpuMask, err := irq.RetrieveCPUMask(irqSmpAffinityFile); err == nil {
-			if bannedCPUMask, err = irq.InvertMaskStringWithComma(cpuMask); err != nil {
-				logrus.Infof("error retrieving banned mask: %v", err)
-				return err
-			}
-		} else {
-			logrus.Infof("error retrieving cpu mask: %v", err)
+		if bannedCPUMask, err = bannedCPUsFromSmpAffinity(); err != nil {
+			logrus.Infof("error retrieving banned mask: %v", err)
 			return err
 		}
-		if err = irq.ResetIRQBalance(irqBalanceConfigFile, bannedCPUMask); err != nil {
+		if err = applyBannedCPUs(setBannedCPUs, staticBannedCPUs, bannedCPUMask); err != nil {
 			logrus.Infof("irqbalance with banned cpus failed: %v", err)
 		}
 	}
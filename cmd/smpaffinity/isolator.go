@@ -0,0 +1,755 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pperiyasamy/irq-smp-balance/pkg/irq"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+// siblingsLedgerContainer records the thread siblings isolated along with the pod cpus
+// in the ledger, it's not a valid container name so it never clashes with one.
+const siblingsLedgerContainer = "@thread-siblings"
+
+// host files the pod isolator changes, tests point them to temporary files
+var (
+	irqSmpAffinityFile   = irq.IrqSmpAffinityProcFile
+	podIrqBannedCPUsFile = irq.PodIrqBannedCPUsFile
+	irqBalanceConfigFile = irq.HostIrqBalanceConfigFile
+	irqProcDir           = irq.IrqProcDir
+	irqLeakReportFile    = irq.IRQLeakReportFile
+)
+
+// podIsolator isolates the cpus of irq labeled pods from handling interrupts
+type podIsolator struct {
+	cms       irq.CPUManagerService
+	snapshots *irq.IRQAffinitySnapshotStore
+	ledger    *irq.CPUOwnershipLedger
+	// isolateSiblings isolates thread siblings of the pod cpus for pods without
+	// IrqIsolateSiblingsAnnotation
+	isolateSiblings bool
+	housekeeping    irq.HousekeepingPolicy
+	recorder        record.EventRecorder
+	// queueMasks strips isolated cpus from rps and xps masks of network queues, nil
+	// leaves the queues alone
+	queueMasks *irq.QueueMaskStore
+	// skipNetNS glob patterns of network namespaces whose queues are left alone
+	skipNetNS []string
+	// workqueueMasks narrows unbound workqueue cpumasks to the housekeeping cpus, nil
+	// leaves the workqueues alone
+	workqueueMasks *irq.WorkqueueMaskStore
+	// housekeepingAffinity keeps kernel threads and host services off isolated cpus,
+	// nil leaves them alone
+	housekeepingAffinity *irq.HousekeepingAffinityStore
+}
+
+func newPodIsolator(cms irq.CPUManagerService, isolateSiblings bool, housekeeping irq.HousekeepingPolicy,
+	recorder record.EventRecorder, queueMasks *irq.QueueMaskStore, skipNetNS []string,
+	workqueueMasks *irq.WorkqueueMaskStore, housekeepingAffinity *irq.HousekeepingAffinityStore) (*podIsolator, error) {
+	snapshots, err := irq.NewIRQAffinitySnapshotStore(irq.IrqAffinitySnapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := irq.NewCPUOwnershipLedger(irq.CPUOwnershipLedgerFile)
+	if err != nil {
+		return nil, err
+	}
+	return &podIsolator{
+		cms:                  cms,
+		snapshots:            snapshots,
+		ledger:               ledger,
+		isolateSiblings:      isolateSiblings,
+		housekeeping:         housekeeping,
+		recorder:             recorder,
+		queueMasks:           queueMasks,
+		skipNetNS:            skipNetNS,
+		workqueueMasks:       workqueueMasks,
+		housekeepingAffinity: housekeepingAffinity,
+	}, nil
+}
+
+func (p *podIsolator) handleAddPod(pod *v1.Pod) {
+	logrus.Infof("pod added %s, %s, %s, %s\n", pod.ObjectMeta.Name, pod.Status.Phase, pod.Status.QOSClass, pod.Spec.NodeName)
+	if pod.Status.QOSClass != v1.PodQOSGuaranteed {
+		logrus.Infof("pod %s is with %s qos class. ignoring", pod.ObjectMeta.Name, pod.Status.QOSClass)
+		return
+	}
+	metrics.PodsHandled.WithLabelValues(metrics.OperationAdd).Inc()
+	podCPUs, err := p.cms.GetAssignedCpus(string(pod.UID))
+	if err != nil {
+		logrus.Errorf("error in retrieving assigned cpus for pod %s: %v", pod.ObjectMeta.Name, err)
+		metrics.PodOperationFailures.WithLabelValues(metrics.OperationAdd).Inc()
+		return
+	}
+	p.isolatePod(pod, podCPUs)
+}
+
+func (p *podIsolator) handleDeletePod(pod *v1.Pod) {
+	logrus.Infof("pod deleted %s, %s, %s, %s\n", pod.ObjectMeta.Name, pod.Status.Phase, pod.Status.QOSClass, pod.Spec.NodeName)
+	if pod.Status.QOSClass != v1.PodQOSGuaranteed {
+		logrus.Infof("pod %s is with %s qos class. ignoring", pod.ObjectMeta.Name, pod.Status.QOSClass)
+		return
+	}
+	metrics.PodsHandled.WithLabelValues(metrics.OperationDelete).Inc()
+	p.releasePod(string(pod.UID), pod.ObjectMeta.Name)
+}
+
+// reconcile converges isolated cpus to the given live irq labeled pods and the cpu
+// manager state rather than replaying add/delete events, which are lost while
+// smpaffinity is not running.
+func (p *podIsolator) reconcile(pods []*v1.Pod) {
+	livePods := make(map[string]*v1.Pod)
+	for _, pod := range pods {
+		if pod.Status.QOSClass == v1.PodQOSGuaranteed {
+			livePods[string(pod.UID)] = pod
+		}
+	}
+	isolatedPods := make(map[string]struct{})
+	for _, podUID := range p.ledger.PodUIDs() {
+		isolatedPods[podUID] = struct{}{}
+		if _, ok := livePods[podUID]; !ok {
+			logrus.Infof("reconcile: pod %s is gone, releasing its cpus", podUID)
+			p.releasePod(podUID, podUID)
+		}
+	}
+	for podUID, pod := range livePods {
+		podCPUs, err := p.cms.GetAssignedCpus(podUID)
+		if err != nil {
+			logrus.Errorf("reconcile: error in retrieving assigned cpus for pod %s: %v", pod.ObjectMeta.Name, err)
+			continue
+		}
+		if err := validatePodCPUs(podCPUs); err != nil {
+			logrus.Errorf("reconcile: refusing cpus %s of pod %s: %v", podCPUs, pod.ObjectMeta.Name, err)
+			continue
+		}
+		if _, ok := isolatedPods[podUID]; !ok {
+			logrus.Infof("reconcile: pod %s is not isolated yet", pod.ObjectMeta.Name)
+			p.isolatePod(pod, podCPUs)
+		}
+	}
+	// converge default smp affinity and pod banned cpus file even when no pod has
+	// changed, so that a previously failed write or a lost update is caught up. only
+	// the cpus in the ledger, admitted by the housekeeping policy for the live pods by
+	// now, and the static banned cpus are taken out, other cpus are left as they are.
+	desiredCPUs := p.ledger.IsolatedCPUs()
+	logrus.Infof("reconcile: desired isolated cpus %s", desiredCPUs)
+	err := irq.ApplyIRQLoadBalancing(p.excludedCPUs(), irqSmpAffinityFile, podIrqBannedCPUsFile)
+	if err != nil {
+		logrus.Errorf("reconcile: set irq load balancing for cpus %s failed: %v", desiredCPUs, err)
+		metrics.PodOperationFailures.WithLabelValues(metrics.OperationReconcile).Inc()
+	}
+	// interfaces and network namespaces come and go with the pods
+	p.excludeQueueMasks(desiredCPUs)
+	p.isolateWorkqueues(desiredCPUs)
+	p.banHousekeepingAffinity(desiredCPUs)
+	p.reportIRQLeaks()
+}
+
+// excludedCPUs returns the cpus kept out of default smp affinity: the ones isolated for
+// the pods and the static banned cpus recorded by irqsmpdaemon.
+func (p *podIsolator) excludedCPUs() string {
+	isolated, err := irq.ParseCPUList(p.ledger.IsolatedCPUs())
+	if err != nil {
+		logrus.Errorf("error parsing isolated cpus: %v", err)
+		return p.ledger.IsolatedCPUs()
+	}
+	return isolated.Union(staticBannedCPUs()).CPUList()
+}
+
+// staticBannedCPUs returns the cpus banned by administrator, none when irqsmpdaemon
+// hasn't recorded them.
+func staticBannedCPUs() irq.CPUMask {
+	staticmask, err := irq.RetrieveStaticBannedCPUs(irqBalanceConfigFile)
+	if err != nil {
+		logrus.Warnf("error retrieving static banned cpus: %v", err)
+	}
+	return staticmask
+}
+
+// handleCPUHotplug reconciles so that banned cpus are recomputed after online cpus
+// changed, checks housekeeping cpus and points irqs left with only offline cpus to them.
+func (p *podIsolator) handleCPUHotplug(event irq.CPUHotplugEvent, pods []*v1.Pod) {
+	isolatedCPUs, err := irq.ParseCPUList(p.ledger.IsolatedCPUs())
+	if err != nil {
+		logrus.Errorf("hotplug: error parsing isolated cpus: %v", err)
+		return
+	}
+	if offlined := event.Offlined.Intersection(isolatedCPUs); !offlined.IsEmpty() {
+		logrus.Warnf("hotplug: isolated cpus %s went offline", offlined.CPUList())
+	}
+	// offline cpus stay in default smp affinity, reconcile recomputes the banned cpus
+	// over the online cpus
+	p.reconcile(pods)
+	isolatedCPUs, _ = irq.ParseCPUList(p.ledger.IsolatedCPUs())
+	// cpus isolated with isolcpus don't count as housekeeping cpus either
+	available := event.Online
+	if topology, err := irq.ReadCPUTopology(irq.CPUTopologyDir); err == nil {
+		available = topology.Housekeeping()
+	}
+	if housekeeping := available.Difference(isolatedCPUs); housekeeping.CPUSet().Size() < p.housekeeping.MinCPUs {
+		logrus.Errorf("hotplug: only %d housekeeping cpus (%s) are online, minimum is %d",
+			housekeeping.CPUSet().Size(), housekeeping.CPUList(), p.housekeeping.MinCPUs)
+	}
+
+	targetMask, err := p.irqTargetMask()
+	if err != nil {
+		logrus.Errorf("hotplug: error retrieving housekeeping cpus: %v", err)
+		return
+	}
+	status, err := irq.RetargetOfflineIRQs(event.Online, targetMask, irqProcDir, numaSteering())
+	if err != nil {
+		logrus.Errorf("hotplug: retargeting irqs off offline cpus failed: %v", err)
+		return
+	}
+	for _, n := range status.MovedIRQs() {
+		logrus.Infof("hotplug: irq %d is moved from offline cpus %s to %s", n, status.Moved[n].Original, status.Moved[n].Applied)
+	}
+	for _, n := range status.CrossNodeIRQs() {
+		logrus.Warnf("hotplug: no housekeeping cpu left on numa node %d, irq %d is moved to remote cpus %s",
+			status.CrossNode[n], n, status.Moved[n].Applied)
+	}
+	for _, n := range status.FailedIRQs() {
+		logrus.Warnf("hotplug: irq %d can not be moved off offline cpus: %v", n, status.Failed[n])
+	}
+	logFailedIRQThreads("hotplug: moving irqs off offline cpus", status)
+	p.reportIRQLeaks()
+}
+
+// isolatePod excludes the pod cpus not owned by another pod yet from irq balancing
+func (p *podIsolator) isolatePod(pod *v1.Pod, podCPUs string) {
+	logrus.Infof("assigned cpus %s for pod %s", podCPUs, pod.ObjectMeta.Name)
+	if podCPUs == "" {
+		return
+	}
+	if err := validatePodCPUs(podCPUs); err != nil {
+		logrus.Errorf("refusing cpus %s of pod %s: %v", podCPUs, pod.ObjectMeta.Name, err)
+		return
+	}
+	containerCPUs, ok := p.admitContainerCPUs(pod, p.isolatedContainerCPUs(pod, podCPUs))
+	if !ok {
+		return
+	}
+	newCPUs, err := p.ledger.Acquire(string(pod.UID), containerCPUs)
+	if err != nil {
+		logrus.Errorf("error recording cpus %s for pod %s: %v", podCPUs, pod.ObjectMeta.Name, err)
+		return
+	}
+	if newCPUs == "" {
+		logrus.Infof("cpus %s for pod %s are already isolated", podCPUs, pod.ObjectMeta.Name)
+		// pin the device irqs even when the cpus were isolated by a previous run or another pod
+		p.pinDeviceIRQs(pod, podCPUs)
+		return
+	}
+	if siblings, ok := containerCPUs[siblingsLedgerContainer]; ok {
+		logrus.Infof("isolating thread siblings %s along with cpus %s for pod %s", siblings, podCPUs, pod.ObjectMeta.Name)
+		p.warnNonIsolatedSiblings(pod, siblings)
+	}
+	err = irq.SetIRQLoadBalancing(newCPUs, false, irqSmpAffinityFile, podIrqBannedCPUsFile)
+	if err != nil {
+		logrus.Errorf("set irq load balancing for pod %s failed: %v", pod.ObjectMeta.Name, err)
+		metrics.PodOperationFailures.WithLabelValues(metrics.OperationAdd).Inc()
+		// forget the pod so that the next add event or reconcile isolates it again
+		if _, err := p.ledger.Release(string(pod.UID)); err != nil {
+			logrus.Errorf("error releasing cpus %s for pod %s: %v", podCPUs, pod.ObjectMeta.Name, err)
+		}
+		return
+	}
+	p.excludeQueueMasks(newCPUs)
+	p.isolateWorkqueues(newCPUs)
+	p.banHousekeepingAffinity(newCPUs)
+	p.excludePodCPUsFromIRQs(pod, newCPUs)
+	p.pinDeviceIRQs(pod, podCPUs)
+	if running, ok := podRunningSince(pod); ok {
+		metrics.IsolationLatency.Observe(time.Since(running).Seconds())
+	}
+	p.reportIRQLeaks()
+}
+
+// podRunningSince returns the time all containers of the pod are running since, false
+// when any of them is not running
+func podRunningSince(pod *v1.Pod) (time.Time, bool) {
+	var since time.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running == nil {
+			return since, false
+		}
+		if started := status.State.Running.StartedAt.Time; started.After(since) {
+			since = started
+		}
+	}
+	return since, !since.IsZero()
+}
+
+// shouldIsolateSiblings returns true if thread siblings of the pod cpus are to be isolated
+func (p *podIsolator) shouldIsolateSiblings(pod *v1.Pod) bool {
+	value, ok := pod.ObjectMeta.Annotations[IrqIsolateSiblingsAnnotation]
+	if !ok {
+		return p.isolateSiblings
+	}
+	isolate, err := strconv.ParseBool(value)
+	if err != nil {
+		logrus.Warnf("invalid %s annotation %q of pod %s", IrqIsolateSiblingsAnnotation, value, pod.ObjectMeta.Name)
+		return p.isolateSiblings
+	}
+	return isolate
+}
+
+// isolatedContainerCPUs returns the cpus to be isolated for the pod per container, along
+// with the thread siblings of the pod cpus when requested.
+func (p *podIsolator) isolatedContainerCPUs(pod *v1.Pod, podCPUs string) map[string]string {
+	containerCPUs := p.cms.GetAssignedContainerCpusFromCache(string(pod.UID))
+	if !p.shouldIsolateSiblings(pod) {
+		return containerCPUs
+	}
+	podmask, err := irq.ParseCPUList(podCPUs)
+	if err != nil {
+		logrus.Errorf("error parsing cpus %s of pod %s: %v", podCPUs, pod.ObjectMeta.Name, err)
+		return containerCPUs
+	}
+	siblings, err := irq.ThreadSiblings(irq.CPUTopologyDir, podmask)
+	if err != nil {
+		logrus.Errorf("error retrieving thread siblings of cpus %s for pod %s: %v", podCPUs, pod.ObjectMeta.Name, err)
+		return containerCPUs
+	}
+	if siblings = siblings.Difference(podmask); !siblings.IsEmpty() {
+		containerCPUs[siblingsLedgerContainer] = siblings.CPUList()
+	}
+	return containerCPUs
+}
+
+// admitContainerCPUs trims the cpus to be isolated for the pod to those admitted by the
+// housekeeping policy, rejected and partially isolated pods are reported in the logs
+// and as pod events.
+func (p *podIsolator) admitContainerCPUs(pod *v1.Pod, containerCPUs map[string]string) (map[string]string, bool) {
+	requested := irq.NewCPUMask()
+	for _, cpus := range containerCPUs {
+		if mask, err := irq.ParseCPUList(cpus); err == nil {
+			requested = requested.Union(mask)
+		}
+	}
+	isolated, err := irq.ParseCPUList(p.ledger.IsolatedCPUs())
+	if err != nil {
+		logrus.Errorf("error parsing isolated cpus: %v", err)
+		return nil, false
+	}
+	topology, err := irq.ReadCPUTopology(irq.CPUTopologyDir)
+	if err != nil {
+		logrus.Errorf("error reading cpu topology: %v", err)
+		return nil, false
+	}
+	admitted, err := p.housekeeping.Admit(requested, isolated, topology.Housekeeping())
+	if err == nil && admitted.IsEmpty() {
+		err = fmt.Errorf("all cpus %s are reserved housekeeping cpus", requested.CPUList())
+	}
+	if err != nil {
+		logrus.Errorf("rejecting irq isolation of pod %s: %v", pod.ObjectMeta.Name, err)
+		p.recorder.Eventf(pod, v1.EventTypeWarning, "IrqIsolationRejected", "cpus are not isolated from interrupts: %v", err)
+		return nil, false
+	}
+	dropped := requested.Difference(admitted)
+	if dropped.IsEmpty() {
+		return containerCPUs, true
+	}
+	logrus.Warnf("reserved housekeeping cpus %s of pod %s are not isolated", dropped.CPUList(), pod.ObjectMeta.Name)
+	p.recorder.Eventf(pod, v1.EventTypeWarning, "IrqIsolationPartial",
+		"reserved housekeeping cpus %s are not isolated from interrupts, cpus %s are", dropped.CPUList(), admitted.CPUList())
+	for container, cpus := range containerCPUs {
+		mask, _ := irq.ParseCPUList(cpus)
+		if mask = mask.Intersection(admitted); mask.IsEmpty() {
+			delete(containerCPUs, container)
+		} else {
+			containerCPUs[container] = mask.CPUList()
+		}
+	}
+	return containerCPUs, true
+}
+
+// warnNonIsolatedSiblings warns about the thread siblings of the pod cpus which run
+// workloads that are not isolated, those still suffer from the interrupts.
+func (p *podIsolator) warnNonIsolatedSiblings(pod *v1.Pod, siblings string) {
+	remaining, err := cpuset.Parse(siblings)
+	if err != nil {
+		return
+	}
+	assignments := p.cms.GetAllAssignedCpusFromCache()
+	isolatedPods := make(map[string]struct{})
+	for _, podUID := range p.ledger.PodUIDs() {
+		isolatedPods[podUID] = struct{}{}
+	}
+	for podUID, cpus := range assignments {
+		podcpuset, err := cpuset.Parse(cpus)
+		if podUID == string(pod.UID) || err != nil {
+			continue
+		}
+		owned := remaining.Intersection(podcpuset)
+		if owned.IsEmpty() {
+			continue
+		}
+		remaining = remaining.Difference(owned)
+		if _, ok := isolatedPods[podUID]; !ok {
+			logrus.Warnf("thread siblings %s of pod %s cpus belong to non-isolated pod %s", owned, pod.ObjectMeta.Name, podUID)
+		}
+	}
+	if !remaining.IsEmpty() {
+		logrus.Warnf("thread siblings %s of pod %s cpus are in the shared pool running non-isolated workloads", remaining, pod.ObjectMeta.Name)
+	}
+}
+
+// validatePodCPUs returns error when the pod cpus name cpus which don't exist
+func validatePodCPUs(podCPUs string) error {
+	podmask, err := irq.ParseCPUList(podCPUs)
+	if err != nil {
+		return err
+	}
+	topology, err := irq.ReadCPUTopology(irq.CPUTopologyDir)
+	if err != nil {
+		return err
+	}
+	return topology.ValidateCPUs(podmask)
+}
+
+// releasePod hands the pod cpus back to irq balancing, except the ones still owned
+// by another pod.
+func (p *podIsolator) releasePod(podUID, podName string) {
+	containerCPUs := p.ledger.ContainerCPUs(podUID)
+	freedCPUs, err := p.ledger.Release(podUID)
+	if err != nil {
+		logrus.Errorf("error releasing cpus for pod %s: %v", podName, err)
+		metrics.PodOperationFailures.WithLabelValues(metrics.OperationDelete).Inc()
+		return
+	}
+	logrus.Infof("released cpus %s for pod %s", freedCPUs, podName)
+	p.restorePinnedIRQs(podUID, podName)
+	if freedCPUs != "" {
+		// static banned cpus stay out of irq balancing
+		enabledCPUs := freedCPUs
+		if freedmask, err := irq.ParseCPUList(freedCPUs); err == nil {
+			enabledCPUs = freedmask.Difference(staticBannedCPUs()).CPUList()
+		}
+		err = irq.SetIRQLoadBalancing(enabledCPUs, true, irqSmpAffinityFile, podIrqBannedCPUsFile)
+		if err != nil {
+			logrus.Errorf("reset irq load balancing for pod %s failed: %v", podName, err)
+			metrics.PodOperationFailures.WithLabelValues(metrics.OperationDelete).Inc()
+			// keep the pod in the ledger so that reconcile releases it again, cpus left
+			// out of default smp affinity are never handed back otherwise
+			if _, err := p.ledger.Acquire(podUID, containerCPUs); err != nil {
+				logrus.Errorf("error recording cpus %s for pod %s again: %v", freedCPUs, podName, err)
+			}
+			return
+		}
+		p.restoreQueueMasks(freedCPUs)
+		p.releaseWorkqueues(freedCPUs)
+		p.unbanHousekeepingAffinity(freedCPUs)
+		p.restoreIRQs(podName, freedCPUs)
+		p.reportIRQLeaks()
+	}
+	p.cms.Remove(podUID)
+}
+
+// excludePodCPUsFromIRQs moves already active irqs off the pod cpus, default smp
+// affinity mask only applies to irqs registered later. original irq masks are saved
+// into snapshots so that those can be restored when the pod is deleted.
+func (p *podIsolator) excludePodCPUsFromIRQs(pod *v1.Pod, podCPUs string) {
+	targetMask, err := p.irqTargetMask()
+	if err != nil {
+		logrus.Errorf("error retrieving housekeeping cpus for pod %s: %v", pod.ObjectMeta.Name, err)
+		return
+	}
+	status, err := irq.ExcludeCPUsFromIRQs(podCPUs, targetMask, irqProcDir, numaSteering())
+	if err != nil {
+		logrus.Errorf("moving irqs off cpus %s for pod %s failed: %v", podCPUs, pod.ObjectMeta.Name, err)
+		return
+	}
+	logrus.Infof("moved %d irqs off cpus %s for pod %s", len(status.Moved), podCPUs, pod.ObjectMeta.Name)
+	for _, n := range status.CrossNodeIRQs() {
+		logrus.Warnf("no housekeeping cpu left on numa node %d, irq %d is moved off cpus %s for pod %s to remote cpus %s",
+			status.CrossNode[n], n, podCPUs, pod.ObjectMeta.Name, status.Moved[n].Applied)
+	}
+	for _, n := range status.FailedIRQs() {
+		logrus.Warnf("irq %d can not be moved off cpus %s for pod %s: %v", n, podCPUs, pod.ObjectMeta.Name, status.Failed[n])
+	}
+	logFailedIRQThreads("moving irqs off cpus "+podCPUs+" for pod "+pod.ObjectMeta.Name, status)
+	if err := p.snapshots.Save(string(pod.UID), podCPUs, status); err != nil {
+		logrus.Errorf("error saving irq affinity snapshot for pod %s: %v", pod.ObjectMeta.Name, err)
+	}
+}
+
+// pinDeviceIRQs pins msi irqs of the devices named by IrqDevicesAnnotation to the pod
+// cpus chosen by IrqDeviceCPUsAnnotation, original irq masks are saved into snapshots
+// so that those can be restored when the pod is deleted.
+func (p *podIsolator) pinDeviceIRQs(pod *v1.Pod, podCPUs string) {
+	devices := irq.ParseDevices(pod.ObjectMeta.Annotations[IrqDevicesAnnotation])
+	if len(devices) == 0 {
+		return
+	}
+	podmask, err := irq.ParseCPUList(podCPUs)
+	if err != nil {
+		logrus.Errorf("error parsing cpus %s of pod %s: %v", podCPUs, pod.ObjectMeta.Name, err)
+		return
+	}
+	cpus := podmask
+	if value, ok := pod.ObjectMeta.Annotations[IrqDeviceCPUsAnnotation]; ok {
+		chosen, err := irq.ParseCPUList(value)
+		if err != nil || chosen.IsEmpty() || !chosen.IsSubsetOf(podmask) {
+			logrus.Warnf("invalid %s annotation %q of pod %s, not a subset of pod cpus %s, pinning to all pod cpus",
+				IrqDeviceCPUsAnnotation, value, pod.ObjectMeta.Name, podCPUs)
+		} else {
+			cpus = chosen
+		}
+	}
+	irqs, err := irq.ResolvePodDeviceIRQs(irq.SysPCIDevicesDir, irq.HostProcDir, string(pod.UID), devices)
+	if err != nil {
+		logrus.Errorf("error resolving irqs of devices %v for pod %s: %v", devices, pod.ObjectMeta.Name, err)
+		return
+	}
+	status := irq.PinIRQs(irqs, cpus, irqProcDir)
+	logrus.Infof("pinned irqs %v of devices %v to cpus %s for pod %s", status.MovedIRQs(), devices, cpus.CPUList(), pod.ObjectMeta.Name)
+	for _, n := range status.FailedIRQs() {
+		logrus.Warnf("irq %d can not be pinned to cpus %s for pod %s: %v", n, cpus.CPUList(), pod.ObjectMeta.Name, status.Failed[n])
+	}
+	logFailedIRQThreads("pinning irqs to cpus "+cpus.CPUList()+" for pod "+pod.ObjectMeta.Name, status)
+	if err := p.snapshots.SavePinned(string(pod.UID), status); err != nil {
+		logrus.Errorf("error saving pinned irq snapshot for pod %s: %v", pod.ObjectMeta.Name, err)
+	}
+}
+
+// restorePinnedIRQs gives the device irqs pinned for the pod their previous mask back
+func (p *podIsolator) restorePinnedIRQs(podUID, podName string) {
+	status, err := p.snapshots.RestorePinned(podUID, irqProcDir)
+	if err != nil {
+		logrus.Errorf("restoring pinned irqs for pod %s failed: %v", podName, err)
+		return
+	}
+	if len(status.Moved) > 0 {
+		logrus.Infof("restored pinned irqs %v for pod %s", status.MovedIRQs(), podName)
+	}
+	for _, n := range status.FailedIRQs() {
+		logrus.Warnf("pinned irq %d affinity can not be restored for pod %s: %v", n, podName, status.Failed[n])
+	}
+	logFailedIRQThreads("restoring pinned irqs for pod "+podName, status)
+}
+
+// excludeQueueMasks strips given cpus from rps and xps masks of the network queues in
+// the host and named network namespaces, so that no softirq work is steered to them.
+func (p *podIsolator) excludeQueueMasks(cpus string) {
+	if p.queueMasks == nil || cpus == "" {
+		return
+	}
+	mask, err := irq.ParseCPUList(cpus)
+	if err != nil {
+		logrus.Errorf("error parsing cpus %s: %v", cpus, err)
+		return
+	}
+	err = irq.ForEachNetworkNamespace(irq.HostSysClassNetDir, irq.HostNetNSDir, p.skipNetNS, func(namespace, netDir string) error {
+		status, err := p.queueMasks.Exclude(namespace, netDir, mask)
+		if len(status.Changed) > 0 {
+			logrus.Infof("stripped cpus %s from rps/xps masks of queues %v", cpus, status.ChangedQueues())
+		}
+		for _, queue := range status.FailedQueues() {
+			logrus.Warnf("cpus %s can not be stripped from rps/xps mask of queue %s: %v", cpus, queue, status.Failed[queue])
+		}
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("stripping cpus %s from rps/xps masks failed: %v", cpus, err)
+	}
+}
+
+// restoreQueueMasks adds given cpus back to rps and xps masks of the network queues
+// which had them, and forgets the queues of network namespaces which are gone.
+func (p *podIsolator) restoreQueueMasks(cpus string) {
+	if p.queueMasks == nil {
+		return
+	}
+	mask, err := irq.ParseCPUList(cpus)
+	if err != nil {
+		logrus.Errorf("error parsing cpus %s: %v", cpus, err)
+		return
+	}
+	visited := make(map[string]struct{})
+	err = irq.ForEachNetworkNamespace(irq.HostSysClassNetDir, irq.HostNetNSDir, p.skipNetNS, func(namespace, netDir string) error {
+		visited[namespace] = struct{}{}
+		status, err := p.queueMasks.Restore(namespace, netDir, mask)
+		if len(status.Changed) > 0 {
+			logrus.Infof("restored cpus %s in rps/xps masks of queues %v", cpus, status.ChangedQueues())
+		}
+		for _, queue := range status.FailedQueues() {
+			logrus.Warnf("cpus %s can not be restored in rps/xps mask of queue %s: %v", cpus, queue, status.Failed[queue])
+		}
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("restoring cpus %s in rps/xps masks failed: %v", cpus, err)
+		return
+	}
+	for _, namespace := range p.queueMasks.Namespaces() {
+		if _, ok := visited[namespace]; !ok {
+			if err := p.queueMasks.Forget(namespace); err != nil {
+				logrus.Errorf("error forgetting rps/xps masks of network namespace %s: %v", namespace, err)
+			}
+		}
+	}
+}
+
+// isolateWorkqueues removes given cpus from the unbound workqueue cpumasks
+func (p *podIsolator) isolateWorkqueues(cpus string) {
+	if p.workqueueMasks == nil || cpus == "" {
+		return
+	}
+	changed, err := p.workqueueMasks.Isolate(cpus)
+	if err != nil {
+		logrus.Errorf("removing cpus %s from workqueue masks failed: %v", cpus, err)
+		return
+	}
+	if len(changed) > 0 {
+		logrus.Infof("removed cpus %s from workqueue masks %v", cpus, changed)
+	}
+}
+
+// releaseWorkqueues adds given cpus back to the unbound workqueue cpumasks, original
+// masks are restored once no isolated cpu is left.
+func (p *podIsolator) releaseWorkqueues(cpus string) {
+	if p.workqueueMasks == nil {
+		return
+	}
+	last := p.ledger.IsolatedCPUs() == ""
+	changed, err := p.workqueueMasks.Release(cpus, last)
+	if err != nil {
+		logrus.Errorf("adding cpus %s back to workqueue masks failed: %v", cpus, err)
+		return
+	}
+	if last {
+		logrus.Infof("no isolated cpu left, restored original workqueue masks %v", changed)
+	} else if len(changed) > 0 {
+		logrus.Infof("added cpus %s back to workqueue masks %v", cpus, changed)
+	}
+}
+
+// banHousekeepingAffinity moves movable kernel threads and host services off given cpus
+func (p *podIsolator) banHousekeepingAffinity(cpus string) {
+	if p.housekeepingAffinity == nil || cpus == "" {
+		return
+	}
+	status, err := p.housekeepingAffinity.Ban(cpus)
+	if err != nil {
+		logrus.Errorf("moving kernel threads and host services off cpus %s failed: %v", cpus, err)
+	}
+	logHousekeepingAffinityStatus("moved kernel threads and host services off cpus "+cpus, status)
+}
+
+// unbanHousekeepingAffinity lets kernel threads and host services run on given cpus
+// again, original affinities are restored once no isolated cpu is left.
+func (p *podIsolator) unbanHousekeepingAffinity(cpus string) {
+	if p.housekeepingAffinity == nil {
+		return
+	}
+	status, err := p.housekeepingAffinity.Unban(cpus, p.ledger.IsolatedCPUs() == "")
+	if err != nil {
+		logrus.Errorf("letting kernel threads and host services on cpus %s failed: %v", cpus, err)
+	}
+	logHousekeepingAffinityStatus("let kernel threads and host services on cpus "+cpus, status)
+}
+
+func logHousekeepingAffinityStatus(what string, status *irq.HousekeepingAffinityStatus) {
+	if len(status.Kthreads) > 0 || len(status.Cgroups) > 0 {
+		logrus.Infof("%s: %d kernel threads, cgroups %v", what, len(status.Kthreads), status.Cgroups)
+	}
+	for name, err := range status.Failed {
+		logrus.Warnf("%s: %s failed: %v", what, name, err)
+	}
+}
+
+// logFailedIRQThreads reports threaded irq handlers which couldn't follow the affinity
+// of their irq, those keep running on the cpus they had.
+func logFailedIRQThreads(what string, status *irq.IRQAffinityStatus) {
+	for _, pid := range status.FailedThreadPIDs() {
+		logrus.Warnf("%s: threaded irq handler %d can not be moved: %v", what, pid, status.FailedThreads[pid])
+	}
+}
+
+// irqTargetMask returns the mask for irqs left without cpu when moved off isolated or
+// offline cpus: the online kubelet system reserved cpus, or else the housekeeping cpus
+// of default smp affinity.
+func (p *podIsolator) irqTargetMask() (string, error) {
+	topology, err := irq.ReadCPUTopology(irq.CPUTopologyDir)
+	if err != nil {
+		return "", err
+	}
+	if target := p.housekeeping.IRQTarget(topology.Housekeeping()); !target.IsEmpty() {
+		return target.Format(topology.Width()), nil
+	}
+	return irq.RetrieveCPUMask(irqSmpAffinityFile)
+}
+
+// numaSteering returns numa steering towards the housekeeping cpus of default smp
+// affinity, nil when the numa topology isn't available.
+func numaSteering() *irq.NUMASteering {
+	steering, err := irq.ReadNUMASteering(irq.SysNodeDir, irq.SysPCIDevicesDir, irqProcDir)
+	if err != nil {
+		logrus.Warnf("error reading numa topology, irqs are moved regardless of numa node: %v", err)
+		return nil
+	}
+	if mask, err := irq.RetrieveCPUMask(irqSmpAffinityFile); err == nil {
+		steering.Housekeeping, _ = irq.ParseCPUMask(mask)
+	}
+	return steering
+}
+
+// reportIRQLeaks logs the irqs still delivered to isolated cpus, such as managed irqs
+// rejecting smp affinity changes, and saves them into IRQLeakReportFile.
+func (p *podIsolator) reportIRQLeaks() {
+	isolated, err := irq.ParseCPUList(p.ledger.IsolatedCPUs())
+	if err != nil {
+		logrus.Errorf("error parsing isolated cpus: %v", err)
+		return
+	}
+	report, err := irq.CheckIRQLeaks(isolated, p.snapshots.PinnedIRQs(), irqProcDir, irq.SysKernelDebugIRQDir,
+		irq.ProcInterruptsFile)
+	if err != nil {
+		logrus.Errorf("error checking irqs on isolated cpus %s: %v", report.IsolatedCPUs, err)
+		return
+	}
+	for _, leak := range report.Leaks {
+		logrus.Warnf("%s irq %d (%s) is still delivered to isolated cpus, effective affinity %s",
+			leak.Class, leak.IRQ, leak.Devices, leak.EffectiveCPUs)
+	}
+	if err := irq.WriteIRQLeakReport(irqLeakReportFile, report); err != nil {
+		logrus.Errorf("error saving irq leak report: %v", err)
+	}
+}
+
+// restoreIRQs plays back irq affinity snapshots for the cpus released by the pod.
+func (p *podIsolator) restoreIRQs(podName, freedCPUs string) {
+	status, err := p.snapshots.Restore(freedCPUs, irqProcDir)
+	if err != nil {
+		logrus.Errorf("restoring irq affinities for pod %s failed: %v", podName, err)
+		return
+	}
+	logrus.Infof("restored %d irq affinities for pod %s", len(status.Moved), podName)
+	for _, n := range status.FailedIRQs() {
+		logrus.Warnf("irq %d affinity can not be restored for pod %s: %v", n, podName, status.Failed[n])
+	}
+	logFailedIRQThreads("restoring irq affinities for pod "+podName, status)
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/irq"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeCPUManagerService hands out the container cpus it's given
+type fakeCPUManagerService struct {
+	containerCPUs map[string]map[string]string
+}
+
+func (f *fakeCPUManagerService) GetAssignedCpus(podUID string) (string, error) {
+	return f.GetAssignedCpusFromCache(podUID), nil
+}
+
+func (f *fakeCPUManagerService) GetAssignedCpusFromCache(podUID string) string {
+	podmask := irq.NewCPUMask()
+	for _, cpus := range f.containerCPUs[podUID] {
+		if mask, err := irq.ParseCPUList(cpus); err == nil {
+			podmask = podmask.Union(mask)
+		}
+	}
+	return podmask.CPUList()
+}
+
+func (f *fakeCPUManagerService) GetAssignedContainerCpusFromCache(podUID string) map[string]string {
+	containerCPUs := make(map[string]string)
+	for container, cpus := range f.containerCPUs[podUID] {
+		containerCPUs[container] = cpus
+	}
+	return containerCPUs
+}
+
+func (f *fakeCPUManagerService) GetAllAssignedCpusFromCache() map[string]string {
+	assignments := make(map[string]string)
+	for podUID := range f.containerCPUs {
+		assignments[podUID] = f.GetAssignedCpusFromCache(podUID)
+	}
+	return assignments
+}
+
+func (f *fakeCPUManagerService) Remove(podUID string) {
+	delete(f.containerCPUs, podUID)
+}
+
+// newTestPodIsolator returns pod isolator with its host files in a temporary directory
+// and given online cpus, until returned func is called
+func newTestPodIsolator(g *WithT, online string, cms irq.CPUManagerService) (*podIsolator, string, func()) {
+	dir, err := ioutil.TempDir("", "isolator")
+	g.Expect(err).NotTo(HaveOccurred())
+	topologyDir := filepath.Join(dir, "cpu")
+	g.Expect(os.Mkdir(topologyDir, 0755)).To(Succeed())
+	for name, cpus := range map[string]string{"possible": online, "present": online, "online": online, "isolated": ""} {
+		g.Expect(ioutil.WriteFile(filepath.Join(topologyDir, name), []byte(cpus+"\n"), 0644)).To(Succeed())
+	}
+	g.Expect(os.Mkdir(filepath.Join(dir, "irq"), 0755)).To(Succeed())
+
+	files := []*string{&irq.CPUTopologyDir, &irqSmpAffinityFile, &podIrqBannedCPUsFile, &irqBalanceConfigFile,
+		&irqProcDir, &irqLeakReportFile}
+	saved := make([]string, len(files))
+	for i, file := range files {
+		saved[i] = *file
+	}
+	irq.CPUTopologyDir = topologyDir
+	irqSmpAffinityFile = filepath.Join(dir, "irq", "default_smp_affinity")
+	podIrqBannedCPUsFile = filepath.Join(dir, "pod_irq_banned_cpus")
+	irqBalanceConfigFile = filepath.Join(dir, "irqbalance")
+	irqProcDir = filepath.Join(dir, "irq")
+	irqLeakReportFile = filepath.Join(dir, "irq_leak_report")
+
+	snapshots, err := irq.NewIRQAffinitySnapshotStore(filepath.Join(dir, "irq_affinity_snapshot"))
+	g.Expect(err).NotTo(HaveOccurred())
+	ledger, err := irq.NewCPUOwnershipLedger(filepath.Join(dir, "cpu_ownership_ledger"))
+	g.Expect(err).NotTo(HaveOccurred())
+	isolator := &podIsolator{
+		cms:       cms,
+		snapshots: snapshots,
+		ledger:    ledger,
+		recorder:  record.NewFakeRecorder(10),
+	}
+	return isolator, dir, func() {
+		for i, file := range files {
+			*file = saved[i]
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func newGuaranteedPod(uid string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: uid, UID: types.UID(uid)},
+		Status:     v1.PodStatus{QOSClass: v1.PodQOSGuaranteed},
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cms := &fakeCPUManagerService{containerCPUs: map[string]map[string]string{
+		"live": {"c1": "2"},
+	}}
+	isolator, dir, cleanup := newTestPodIsolator(g, "0-7", cms)
+	defer cleanup()
+
+	// cpu 0 is banned by administrator, cpu 3 is left out of default smp affinity by
+	// tuned, cpu 7 is recorded as static banned cpu and the pods own cpus 1-2
+	g.Expect(ioutil.WriteFile(irqSmpAffinityFile, []byte("000000f0"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(podIrqBannedCPUsFile, []byte("0000000f"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(irqBalanceConfigFile,
+		[]byte("IRQBALANCE_BANNED_CPUS=\"0000008f\"\nIRQSMP_STATIC_BANNED_CPUS=\"00000081\"\n"), 0644)).To(Succeed())
+	_, err := isolator.ledger.Acquire("gone", map[string]string{"c1": "1"})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = isolator.ledger.Acquire("live", map[string]string{"c1": "2"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// the gone pod hands cpu 1 back, cpus 0 and 3 stay banned and cpu 7 is banned
+	isolator.reconcile([]*v1.Pod{newGuaranteedPod("live")})
+	g.Expect(isolator.ledger.PodUIDs()).To(Equal([]string{"live"}))
+	mask, err := irq.RetrieveCPUMask(irqSmpAffinityFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000072"))
+	mask, err = irq.RetrieveCPUMask(podIrqBannedCPUsFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("0000008d"))
+	_, err = os.Stat(filepath.Join(dir, "irq_leak_report"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// nothing has changed, nothing is written
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	g.Expect(os.Chtimes(irqSmpAffinityFile, past, past)).To(Succeed())
+	g.Expect(os.Chtimes(podIrqBannedCPUsFile, past, past)).To(Succeed())
+	isolator.reconcile([]*v1.Pod{newGuaranteedPod("live")})
+	for _, file := range []string{irqSmpAffinityFile, podIrqBannedCPUsFile} {
+		info, err := os.Stat(file)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(info.ModTime().Equal(past)).To(BeTrue())
+	}
+}
+
+func TestReconcileFailure(t *testing.T) {
+	g := NewGomegaWithT(t)
+	isolator, _, cleanup := newTestPodIsolator(g, "0-7", &fakeCPUManagerService{})
+	defer cleanup()
+
+	// default smp affinity can't be read
+	failures := testutil.ToFloat64(metrics.PodOperationFailures.WithLabelValues(metrics.OperationReconcile))
+	isolator.reconcile(nil)
+	g.Expect(testutil.ToFloat64(metrics.PodOperationFailures.WithLabelValues(metrics.OperationReconcile))).
+		To(Equal(failures + 1))
+}
+
+func TestHandleCPUHotplug(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cms := &fakeCPUManagerService{containerCPUs: map[string]map[string]string{
+		"live": {"c1": "1"},
+	}}
+	isolator, _, cleanup := newTestPodIsolator(g, "0-7", cms)
+	defer cleanup()
+	pods := []*v1.Pod{newGuaranteedPod("live")}
+
+	// cpu 6 is banned by administrator, the pod owns cpu 1
+	g.Expect(ioutil.WriteFile(irqSmpAffinityFile, []byte("000000bd"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(podIrqBannedCPUsFile, []byte("00000042"), 0644)).To(Succeed())
+	_, err := isolator.ledger.Acquire("live", map[string]string{"c1": "1"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	setOnline := func(online string) irq.CPUHotplugEvent {
+		g.Expect(ioutil.WriteFile(filepath.Join(irq.CPUTopologyDir, "online"), []byte(online+"\n"), 0644)).To(Succeed())
+		mask, err := irq.ParseCPUList(online)
+		g.Expect(err).NotTo(HaveOccurred())
+		return irq.CPUHotplugEvent{Online: mask}
+	}
+	// offline cpus are never banned, default smp affinity keeps them
+	isolator.handleCPUHotplug(setOnline("0-5"), pods)
+	mask, err := irq.RetrieveCPUMask(irqSmpAffinityFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("000000bd"))
+	mask, err = irq.RetrieveCPUMask(podIrqBannedCPUsFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000002"))
+
+	// cpu 6 is banned again once online, cpu 7 takes interrupts
+	isolator.handleCPUHotplug(setOnline("0-7"), pods)
+	mask, err = irq.RetrieveCPUMask(irqSmpAffinityFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("000000bd"))
+	mask, err = irq.RetrieveCPUMask(podIrqBannedCPUsFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000042"))
+}
+
+func TestAdmitContainerCPUs(t *testing.T) {
+	tcases := []struct {
+		name          string
+		housekeeping  irq.HousekeepingPolicy
+		isolated      string
+		containerCPUs map[string]string
+		admitted      map[string]string
+		event         string
+	}{
+		{
+			name:          "all cpus admitted",
+			housekeeping:  irq.HousekeepingPolicy{MinCPUs: 1},
+			containerCPUs: map[string]string{"c1": "2-3", "c2": "4"},
+			admitted:      map[string]string{"c1": "2-3", "c2": "4"},
+		},
+		{
+			name:          "reserved cpus left out",
+			housekeeping:  irq.HousekeepingPolicy{Reserved: cpuMask("0-1"), MinCPUs: 1},
+			containerCPUs: map[string]string{"c1": "1-2", "c2": "1", siblingsLedgerContainer: "5"},
+			admitted:      map[string]string{"c1": "2", siblingsLedgerContainer: "5"},
+			event:         "Warning IrqIsolationPartial reserved housekeeping cpus 1 are not isolated from interrupts, cpus 2,5 are",
+		},
+		{
+			name:          "minimum housekeeping cpus breached",
+			housekeeping:  irq.HousekeepingPolicy{MinCPUs: 2},
+			isolated:      "4-6",
+			containerCPUs: map[string]string{"c1": "0-3"},
+			event:         "Warning IrqIsolationRejected cpus are not isolated from interrupts: isolating cpus 0-3 leaves 1 housekeeping cpus (7), minimum is 2",
+		},
+		{
+			name:          "kubelet system reserved cpus requested",
+			housekeeping:  irq.HousekeepingPolicy{MinCPUs: 1, SystemReserved: cpuMask("0")},
+			containerCPUs: map[string]string{"c1": "0-1"},
+			event:         "Warning IrqIsolationRejected cpus are not isolated from interrupts: cpus 0 are reserved for the system by kubelet",
+		},
+		{
+			name:          "only reserved cpus requested",
+			housekeeping:  irq.HousekeepingPolicy{Reserved: cpuMask("2-3"), MinCPUs: 1},
+			containerCPUs: map[string]string{"c1": "2-3"},
+			event:         "Warning IrqIsolationRejected cpus are not isolated from interrupts: all cpus 2-3 are reserved housekeeping cpus",
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			isolator, _, cleanup := newTestPodIsolator(g, "0-7", &fakeCPUManagerService{})
+			defer cleanup()
+			isolator.housekeeping = tc.housekeeping
+			if tc.isolated != "" {
+				_, err := isolator.ledger.Acquire("other", map[string]string{"c1": tc.isolated})
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+
+			admitted, ok := isolator.admitContainerCPUs(newGuaranteedPod("pod"), tc.containerCPUs)
+			g.Expect(ok).To(Equal(tc.admitted != nil))
+			if tc.admitted != nil {
+				g.Expect(admitted).To(Equal(tc.admitted))
+			}
+			events := isolator.recorder.(*record.FakeRecorder).Events
+			if tc.event == "" {
+				g.Expect(events).NotTo(Receive())
+			} else {
+				g.Expect(events).To(Receive(Equal(tc.event)))
+			}
+		})
+	}
+}
+
+func cpuMask(cpus string) irq.CPUMask {
+	mask, _ := irq.ParseCPUList(cpus)
+	return mask
+}
@@ -17,22 +17,30 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/pperiyasamy/irq-smp-balance/pkg/irq"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -40,9 +48,52 @@ const (
 	WorkerNodeName string = "WORKER_NODE_NAME"
 	// IrqLabelSelector label selector for the pod which needs interrupt masking
 	IrqLabelSelector string = "irq-load-balancing.docker.io=true"
+	// IrqIsolateSiblingsAnnotation pod annotation deciding whether thread siblings of the
+	// pod cpus are isolated too, overrides -isolate-siblings option
+	IrqIsolateSiblingsAnnotation string = "irq-load-balancing.docker.io/isolate-siblings"
+	// IrqDevicesAnnotation pod annotation naming the comma separated pci addresses or
+	// network interfaces of the pod whose msi irqs are pinned to the pod cpus
+	IrqDevicesAnnotation string = "irq-load-balancing.docker.io/devices"
+	// IrqDeviceCPUsAnnotation pod annotation choosing the pod cpus the device irqs are
+	// pinned to, all the pod cpus by default
+	IrqDeviceCPUsAnnotation string = "irq-load-balancing.docker.io/device-cpus"
+
+	defaultResyncPeriod   = 5 * time.Minute
+	defaultDriftInterval  = time.Minute
+	defaultMetricsAddress = ":9090"
 )
 
 func main() {
+	resyncPeriod := flag.Duration("resync-period", defaultResyncPeriod, "informer resync and isolated cpus reconcile period")
+	driftModeName := flag.String("drift-mode", string(irq.DriftModeReport), "what to do when irq masks drift from the desired state: off, report or repair")
+	driftInterval := flag.Duration("drift-interval", defaultDriftInterval, "irq masks drift verification interval")
+	isolateSiblings := flag.Bool("isolate-siblings", false, "isolate thread siblings of the pod cpus too, unless the pod annotation "+IrqIsolateSiblingsAnnotation+" says otherwise")
+	reservedCPUs := flag.String("reserved-cpus", "", "cpulist of housekeeping cpus which are never isolated from interrupts")
+	minHousekeepingCPUs := flag.Int("min-housekeeping-cpus", irq.DefaultMinHousekeepingCPUs, "minimum number of online cpus never isolated from interrupts")
+	hotplugInterval := flag.Duration("hotplug-interval", irq.DefaultHotplugInterval, "online cpus polling interval")
+	kubeletConfigFile := flag.String("kubelet-config", irq.KubeletConfigFile, "kubelet config file to read reservedSystemCPUs from")
+	queueMasks := flag.Bool("queue-masks", true, "strip isolated cpus from rps and xps masks of network queues")
+	skipInterfaces := flag.String("skip-interfaces", "lo", "comma separated glob patterns of interfaces whose rps and xps masks are left alone")
+	skipNetNS := flag.String("skip-netns", "", "comma separated glob patterns of named network namespaces whose rps and xps masks are left alone")
+	workqueueMasks := flag.Bool("workqueue-masks", true, "narrow unbound workqueue cpumasks to the housekeeping cpus while isolated pods exist")
+	housekeepingAffinity := flag.Bool("housekeeping-affinity", false, "move movable kernel threads and host services off isolated cpus, needs host pid namespace")
+	kubeletConfigz := flag.Bool("kubelet-configz", false, "read reservedSystemCPUs from kubelet /configz endpoint when the kubelet config file doesn't set them, needs get on nodes/proxy")
+	leakageInterval := flag.Duration("leakage-interval", irq.DefaultLeakageInterval, "interrupt sampling interval on isolated cpus, 0 disables the sampling")
+	leakageThreshold := flag.Float64("leakage-threshold", irq.DefaultLeakageThreshold, "interrupts per second above which an interrupt source on an isolated cpu is flagged")
+	metricsAddress := flag.String("metrics-address", defaultMetricsAddress, "address to serve prometheus metrics on, empty disables the metrics")
+	flag.Parse()
+
+	driftMode, err := irq.ParseDriftMode(*driftModeName)
+	if err != nil {
+		logrus.Errorf("%v", err)
+		return
+	}
+	reserved, err := irq.ParseCPUList(*reservedCPUs)
+	if err != nil {
+		logrus.Errorf("invalid reserved cpus %s: %v", *reservedCPUs, err)
+		return
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM,
 		syscall.SIGQUIT)
@@ -55,17 +106,64 @@ func main() {
 	}
 
 	logrus.Infof("starting irq-smp-balance in %s", worker)
+	metrics.Serve(*metricsAddress)
 
 	// creates the in-cluster config
 	clientSet := getClient()
 
+	housekeeping := irq.HousekeepingPolicy{
+		Reserved:       reserved,
+		MinCPUs:        *minHousekeepingCPUs,
+		SystemReserved: discoverKubeletReservedCPUs(*kubeletConfigFile, *kubeletConfigz, worker),
+	}
+
 	cms, err := irq.NewCPUManagerService()
 	if err != nil {
 		logrus.Errorf("error retrieving the cpumanager service")
 		return
 	}
 
-	factory := informers.NewFilteredSharedInformerFactory(clientSet, 0, "", func(o *metav1.ListOptions) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	defer broadcaster.Shutdown()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "irq-smp-balance", Host: worker})
+
+	var queueMaskStore *irq.QueueMaskStore
+	if *queueMasks {
+		queueMaskStore, err = irq.NewQueueMaskStore(irq.QueueMaskStoreFile, splitList(*skipInterfaces))
+		if err != nil {
+			logrus.Errorf("error loading rps/xps mask store: %v", err)
+			return
+		}
+	}
+
+	var workqueueMaskStore *irq.WorkqueueMaskStore
+	if *workqueueMasks {
+		workqueueMaskStore, err = irq.NewWorkqueueMaskStore(irq.SysWorkqueueDir, irq.WorkqueueMaskStoreFile)
+		if err != nil {
+			logrus.Errorf("error loading workqueue mask store: %v", err)
+			return
+		}
+	}
+
+	var housekeepingAffinityStore *irq.HousekeepingAffinityStore
+	if *housekeepingAffinity {
+		housekeepingAffinityStore, err = irq.NewHousekeepingAffinityStore(irq.HostProcDir, irq.HostCgroupDir,
+			irq.HousekeepingAffinityStoreFile)
+		if err != nil {
+			logrus.Errorf("error loading housekeeping affinity store: %v", err)
+			return
+		}
+	}
+
+	isolator, err := newPodIsolator(cms, *isolateSiblings, housekeeping, recorder, queueMaskStore, splitList(*skipNetNS),
+		workqueueMaskStore, housekeepingAffinityStore)
+	if err != nil {
+		logrus.Errorf("error initializing pod isolator: %v", err)
+		return
+	}
+
+	factory := informers.NewFilteredSharedInformerFactory(clientSet, *resyncPeriod, "", func(o *metav1.ListOptions) {
 		o.LabelSelector = IrqLabelSelector
 		o.FieldSelector = fmt.Sprintf("spec.nodeName=%s,status.phase=Running", worker)
 	})
@@ -73,10 +171,20 @@ func main() {
 	mutex := &sync.Mutex{}
 	stopper := make(chan struct{})
 
+	// tuned, irqbalance or an operator may rewrite the masks behind our back
+	verifier := irq.NewDriftVerifier(driftMode, *driftInterval, mutex,
+		irq.NewSmpAffinityDriftChecks(isolator.excludedCPUs, irqSmpAffinityFile, podIrqBannedCPUsFile)...)
+	go verifier.Run(stopper)
+
+	// isolation only helps when no interrupt keeps hitting the isolated cpus
+	leakage := irq.NewLeakageMonitor(irq.ProcInterruptsFile, *leakageInterval, *leakageThreshold,
+		podCPUOwners(isolator.ledger, informer.GetStore()))
+	go leakage.Run(stopper)
+
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			mutex.Lock()
-			handleAddPod(obj.(*v1.Pod), cms)
+			isolator.handleAddPod(obj.(*v1.Pod))
 			mutex.Unlock()
 		},
 		// don't need to handle update event.
@@ -84,7 +192,7 @@ func main() {
 		// editing IrqLabelSelector comes as add/delete event.
 		DeleteFunc: func(obj interface{}) {
 			mutex.Lock()
-			handleDeletePod(obj.(*v1.Pod), cms)
+			isolator.handleDeletePod(obj.(*v1.Pod))
 			mutex.Unlock()
 		},
 	})
@@ -99,11 +207,58 @@ func main() {
 		atomic.StoreInt32(&(isRunning), int32(0))
 	}()
 
+	// pods deleted while smpaffinity is not running never come as delete event, so
+	// converge isolated cpus to the live pods at startup and on every resync.
+	go func() {
+		if !cache.WaitForCacheSync(stopper, informer.HasSynced) {
+			return
+		}
+		hotplug, err := irq.NewHotplugWatcher(irq.SysCPUDir, *hotplugInterval, func(event irq.CPUHotplugEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			isolator.handleCPUHotplug(event, listPods(informer.GetStore()))
+		})
+		if err != nil {
+			logrus.Errorf("error watching cpu hotplug: %v", err)
+		} else {
+			go hotplug.Run(stopper)
+		}
+		reconcile := func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			isolator.reconcile(listPods(informer.GetStore()))
+		}
+		if *resyncPeriod <= 0 {
+			// no resync, converge once at startup
+			reconcile()
+			return
+		}
+		wait.Until(reconcile, *resyncPeriod, stopper)
+	}()
+
 	go func() {
 		sig := <-sigs
 		logrus.Infof("received the signal %v", sig)
 		done <- true
 	}()
+
+	// dump cpu ownership ledger, irq leak report and interrupt rates on SIGUSR1 for debugging
+	dumpSigs := make(chan os.Signal, 1)
+	signal.Notify(dumpSigs, syscall.SIGUSR1)
+	go func() {
+		for range dumpSigs {
+			logrus.Infof("cpu ownership ledger: %s", isolator.ledger)
+			if report, err := irq.ReadIRQLeakReport(irqLeakReportFile); err != nil {
+				logrus.Errorf("error reading irq leak report: %v", err)
+			} else {
+				logrus.Infof("irqs on isolated cpus %s: %+v, managed irqs %v, unknown irqs %v", report.IsolatedCPUs,
+					report.Leaks, report.Managed, report.Unknown)
+			}
+			if sample := leakage.LastSample(); sample != nil {
+				logrus.Infof("interrupt rates of isolated cpus %v, above threshold: %+v", sample.CPURates, sample.Flagged)
+			}
+		}
+	}()
 	// Capture signals to cleanup before exiting
 	<-done
 
@@ -120,49 +275,83 @@ func main() {
 	logrus.Infof("irq-smp-balance is stopped")
 }
 
-func handleAddPod(pod *v1.Pod, cms irq.CPUManagerService) {
-	logrus.Infof("pod added %s, %s, %s, %s\n", pod.ObjectMeta.Name, pod.Status.Phase, pod.Status.QOSClass, pod.Spec.NodeName)
-	if pod.Status.QOSClass != v1.PodQOSGuaranteed {
-		logrus.Infof("pod %s is with %s qos class. ignoring", pod.ObjectMeta.Name, pod.Status.QOSClass)
-		return
-	}
-	podUID := string(pod.UID)
-	podCPUs, err := cms.GetAssignedCpus(podUID)
-	if err != nil {
-		logrus.Errorf("error in retrieving assigned cpus for pod %s: %v", pod.ObjectMeta.Name, err)
-		return
+// splitList returns the non-empty items of comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	logrus.Infof("assigned cpus %s for pod %s", podCPUs, pod.ObjectMeta.Name)
-	if podCPUs != "" {
-		err = irq.SetIRQLoadBalancing(podCPUs, false, irq.IrqSmpAffinityProcFile, irq.PodIrqBannedCPUsFile)
-		if err != nil {
-			logrus.Errorf("set irq load balancing for pod %s failed: %v", pod.ObjectMeta.Name, err)
-			return
+	return items
+}
+
+func listPods(store cache.Store) []*v1.Pod {
+	objs := store.List()
+	pods := make([]*v1.Pod, 0, len(objs))
+	for _, obj := range objs {
+		if pod, ok := obj.(*v1.Pod); ok {
+			pods = append(pods, pod)
 		}
 	}
+	return pods
 }
 
-func handleDeletePod(pod *v1.Pod, cms irq.CPUManagerService) {
-	logrus.Infof("pod deleted %s, %s, %s, %s\n", pod.ObjectMeta.Name, pod.Status.Phase, pod.Status.QOSClass, pod.Spec.NodeName)
-	if pod.Status.QOSClass != v1.PodQOSGuaranteed {
-		logrus.Infof("pod %s is with %s qos class. ignoring", pod.ObjectMeta.Name, pod.Status.QOSClass)
-		return
+// podCPUOwners returns owners of the isolated cpus, with pod names in place of the pod
+// uids for the pods known by the informer
+func podCPUOwners(ledger *irq.CPUOwnershipLedger, store cache.Store) func() map[int][]string {
+	return func() map[int][]string {
+		names := make(map[string]string)
+		for _, pod := range listPods(store) {
+			names[string(pod.UID)] = pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name
+		}
+		owners := ledger.CPUOwners()
+		for _, cpuOwners := range owners {
+			for i, owner := range cpuOwners {
+				fields := strings.SplitN(owner, "/", 2)
+				if name, ok := names[fields[0]]; ok && len(fields) == 2 {
+					cpuOwners[i] = name + "/" + fields[1]
+				}
+			}
+		}
+		return owners
 	}
-	podUID := string(pod.UID)
-	podCPUs, err := cms.GetAssignedCpus(podUID)
+}
+
+// discoverKubeletReservedCPUs returns reservedSystemCPUs from the kubelet config file,
+// or else, when configz is enabled, from the kubelet /configz endpoint proxied by the
+// api server.
+func discoverKubeletReservedCPUs(configFile string, configz bool, worker string) irq.CPUMask {
+	reserved, err := irq.ReadKubeletReservedCPUsFromFile(configFile)
 	if err != nil {
-		logrus.Warnf("not able to retrieve assigned cpus for pod %s: %v", pod.ObjectMeta.Name, err)
-		podCPUs = cms.GetAssignedCpusFromCache(podUID)
+		logrus.Warnf("error reading kubelet reserved system cpus from %s: %v", configFile, err)
 	}
-	logrus.Infof("assigned cpus %s for pod %s", podCPUs, pod.ObjectMeta.Name)
-	if podCPUs != "" {
-		err = irq.SetIRQLoadBalancing(podCPUs, true, irq.IrqSmpAffinityProcFile, irq.PodIrqBannedCPUsFile)
+	if reserved.IsEmpty() && configz {
+		reserved, err = readKubeletReservedCPUsFromConfigz(worker)
 		if err != nil {
-			logrus.Errorf("reset irq load balancing for pod %s failed: %v", pod.ObjectMeta.Name, err)
-			return
+			logrus.Warnf("error reading kubelet reserved system cpus from configz: %v", err)
 		}
 	}
-	cms.Remove(podUID)
+	if reserved.IsEmpty() {
+		logrus.Infof("no kubelet reserved system cpus found")
+	} else {
+		logrus.Infof("kubelet reserved system cpus are %s", reserved.CPUList())
+	}
+	return reserved
+}
+
+func readKubeletReservedCPUsFromConfigz(worker string) (irq.CPUMask, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return irq.NewCPUMask(), err
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return irq.NewCPUMask(), err
+	}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	url := fmt.Sprintf("%s/api/v1/nodes/%s/proxy/configz", strings.TrimSuffix(config.Host, "/"), worker)
+	return irq.ReadKubeletReservedCPUsFromConfigz(client, url)
 }
 
 // GetClient returns a k8s clientset to the request from inside of cluster
@@ -3,13 +3,17 @@ module github.com/pperiyasamy/irq-smp-balance
 go 1.13
 
 require (
+	github.com/coreos/go-systemd/v22 v22.1.0
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/onsi/gomega v1.7.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/sys v0.0.0-20200622214017-ed371f2e16b4
 	k8s.io/api v0.0.0
 	k8s.io/apimachinery v0.0.0
 	k8s.io/client-go v0.0.0
 	k8s.io/kubernetes v1.20.0-beta.0.0.20201030114605-f78d095d52a9
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace (
@@ -0,0 +1,243 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// IrqProcDir directory containing per irq settings
+	IrqProcDir = "/host/proc/irq"
+	// irqSmpAffinityFileName per irq file containing the irq mask
+	irqSmpAffinityFileName = "smp_affinity"
+)
+
+// IRQAffinityStatus outcome of changing per irq smp affinity masks
+type IRQAffinityStatus struct {
+	// Moved irqs with their mask before and after the change
+	Moved map[int]IRQAffinityChange
+	// Failed irqs which kernel refused to move
+	Failed map[int]error
+	// CrossNode irqs moved to cpus off the numa node of their device, with the node
+	CrossNode map[int]int
+	// FailedThreads threaded irq handlers, by pid, which couldn't follow their irq
+	FailedThreads map[int]error
+}
+
+// IRQAffinityChange smp affinity mask of an irq before and after the change
+type IRQAffinityChange struct {
+	Original string `json:"original"`
+	Applied  string `json:"applied"`
+}
+
+// FailedIRQs returns sorted irq numbers which couldn't be moved
+func (s *IRQAffinityStatus) FailedIRQs() []int {
+	irqs := make([]int, 0, len(s.Failed))
+	for irq := range s.Failed {
+		irqs = append(irqs, irq)
+	}
+	sort.Ints(irqs)
+	return irqs
+}
+
+// MovedIRQs returns sorted irq numbers which were moved
+func (s *IRQAffinityStatus) MovedIRQs() []int {
+	irqs := make([]int, 0, len(s.Moved))
+	for irq := range s.Moved {
+		irqs = append(irqs, irq)
+	}
+	sort.Ints(irqs)
+	return irqs
+}
+
+// FailedThreadPIDs returns sorted pids of threaded irq handlers which couldn't be moved
+func (s *IRQAffinityStatus) FailedThreadPIDs() []int {
+	pids := make([]int, 0, len(s.FailedThreads))
+	for pid := range s.FailedThreads {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// CrossNodeIRQs returns sorted irq numbers which were moved off their numa node
+func (s *IRQAffinityStatus) CrossNodeIRQs() []int {
+	irqs := make([]int, 0, len(s.CrossNode))
+	for irq := range s.CrossNode {
+		irqs = append(irqs, irq)
+	}
+	sort.Ints(irqs)
+	return irqs
+}
+
+func newIRQAffinityStatus() *IRQAffinityStatus {
+	return &IRQAffinityStatus{
+		Moved:         make(map[int]IRQAffinityChange),
+		Failed:        make(map[int]error),
+		CrossNode:     make(map[int]int),
+		FailedThreads: make(map[int]error),
+	}
+}
+
+// ListIRQs returns sorted irq numbers present in the irq proc directory
+func ListIRQs(irqProcDir string) ([]int, error) {
+	entries, err := ioutil.ReadDir(irqProcDir)
+	if err != nil {
+		return nil, err
+	}
+	var irqs []int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		irq, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		irqs = append(irqs, irq)
+	}
+	sort.Ints(irqs)
+	return irqs, nil
+}
+
+// RetrieveIRQSmpAffinity retrieves the smp affinity mask of given irq
+func RetrieveIRQSmpAffinity(irqProcDir string, irq int) (string, error) {
+	return RetrieveCPUMask(irqSmpAffinityFile(irqProcDir, irq))
+}
+
+// ExcludeCPUsFromIRQs removes given cpus from smp affinity mask of every irq
+// currently allowed to run on them. When no cpu is left in the irq mask, the irq
+// falls back to housekeepingMask. With numa steering, cpus on the numa node of the
+// irq device are preferred and irqs moved off their node are reported in the status.
+// IRQs which kernel refused to move are reported in the returned status rather than
+// failing the whole operation.
+func ExcludeCPUsFromIRQs(cpus, housekeepingMask, irqProcDir string, steering *NUMASteering) (*IRQAffinityStatus, error) {
+	podmask, err := ParseCPUList(cpus)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := ParseCPUMask(housekeepingMask)
+	if err != nil {
+		return nil, err
+	}
+	irqs, err := ListIRQs(irqProcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	status := newIRQAffinityStatus()
+	threads := listIRQThreads()
+	for _, irq := range irqs {
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		if err != nil {
+			// not every irq exposes smp_affinity, e.g. irq 0 on some platforms
+			continue
+		}
+		currentmask, err := ParseCPUMask(current)
+		if err != nil {
+			logrus.Warnf("error parsing smp affinity %s of irq %d: %v", current, irq, err)
+			continue
+		}
+		if currentmask.Intersection(podmask).IsEmpty() {
+			continue
+		}
+		target, crossNode := steering.Target(irq, currentmask.Difference(podmask), fallback)
+		newMask := target.Format(maskWidth(current))
+		if target.Equals(fallback) {
+			newMask = housekeepingMask
+		}
+		if err := writeIRQSmpAffinity(irqProcDir, irq, newMask); err != nil {
+			status.Failed[irq] = err
+			continue
+		}
+		status.Moved[irq] = IRQAffinityChange{Original: current, Applied: newMask}
+		threads.follow(irq, newMask, status)
+		if crossNode {
+			status.CrossNode[irq] = steering.IRQNodes[irq]
+		}
+	}
+	if len(status.Failed) > 0 {
+		logrus.Warnf("kernel refused to move irqs %v off cpus %s", status.FailedIRQs(), cpus)
+	}
+	return status, nil
+}
+
+// RetargetOfflineIRQs points irqs whose smp affinity has no online cpu left to
+// housekeepingMask, so that no irq affinity names only dead cpus after cpu hotplug.
+// With numa steering, housekeeping cpus on the numa node of the irq device are
+// preferred as in ExcludeCPUsFromIRQs.
+func RetargetOfflineIRQs(online CPUMask, housekeepingMask, irqProcDir string, steering *NUMASteering) (*IRQAffinityStatus, error) {
+	fallback, err := ParseCPUMask(housekeepingMask)
+	if err != nil {
+		return nil, err
+	}
+	irqs, err := ListIRQs(irqProcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	status := newIRQAffinityStatus()
+	threads := listIRQThreads()
+	for _, irq := range irqs {
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		if err != nil {
+			continue
+		}
+		currentmask, err := ParseCPUMask(current)
+		if err != nil {
+			logrus.Warnf("error parsing smp affinity %s of irq %d: %v", current, irq, err)
+			continue
+		}
+		if !currentmask.Intersection(online).IsEmpty() {
+			continue
+		}
+		target, crossNode := steering.Target(irq, NewCPUMask(), fallback)
+		newMask := target.Format(maskWidth(current))
+		if target.Equals(fallback) {
+			newMask = housekeepingMask
+		}
+		if err := writeIRQSmpAffinity(irqProcDir, irq, newMask); err != nil {
+			status.Failed[irq] = err
+			continue
+		}
+		status.Moved[irq] = IRQAffinityChange{Original: current, Applied: newMask}
+		threads.follow(irq, newMask, status)
+		if crossNode {
+			status.CrossNode[irq] = steering.IRQNodes[irq]
+		}
+	}
+	return status, nil
+}
+
+func irqSmpAffinityFile(irqProcDir string, irq int) string {
+	return filepath.Join(irqProcDir, strconv.Itoa(irq), irqSmpAffinityFileName)
+}
+
+// writeIRQSmpAffinity writes the mask into smp affinity of the irq and remembers
+// whether kernel rejected it as a managed irq.
+func writeIRQSmpAffinity(irqProcDir string, irq int, mask string) error {
+	file := irqSmpAffinityFile(irqProcDir, irq)
+	err := ioutil.WriteFile(file, []byte(mask), 0o644)
+	recordIRQSmpAffinityWrite(file, err)
+	return err
+}
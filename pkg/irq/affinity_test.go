@@ -0,0 +1,130 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func createIRQProcDir(g *WithT, masks map[int]string) string {
+	dir, err := ioutil.TempDir("", "irq")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "default_smp_affinity"), []byte("ff"), 0644)).NotTo(HaveOccurred())
+	for irq, mask := range masks {
+		irqDir := filepath.Join(dir, strconv.Itoa(irq))
+		g.Expect(os.Mkdir(irqDir, 0755)).NotTo(HaveOccurred())
+		g.Expect(ioutil.WriteFile(filepath.Join(irqDir, irqSmpAffinityFileName), []byte(mask+"\n"), 0644)).NotTo(HaveOccurred())
+	}
+	return dir
+}
+
+func TestListIRQs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{120: "ff", 8: "ff", 24: "ff"})
+	defer os.RemoveAll(dir)
+
+	irqs, err := ListIRQs(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(irqs).To(Equal([]int{8, 24, 120}))
+}
+
+func TestExcludeCPUsFromIRQs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		24: "00000000,000000ff",
+		25: "00000000,00000006",
+		26: "00000000,000000f0",
+	})
+	defer os.RemoveAll(dir)
+
+	status, err := ExcludeCPUsFromIRQs("1-2", "00000000,000000f9", dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Failed).To(BeEmpty())
+	g.Expect(status.Moved).To(HaveLen(2))
+	g.Expect(status.Moved[24]).To(Equal(IRQAffinityChange{Original: "00000000,000000ff", Applied: "00000000,000000f9"}))
+
+	mask, err := RetrieveIRQSmpAffinity(dir, 24)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000f9"))
+
+	// irq 25 had only pod cpus, falls back to housekeeping mask
+	mask, err = RetrieveIRQSmpAffinity(dir, 25)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000f9"))
+
+	// irq 26 doesn't run on pod cpus, left untouched
+	mask, err = RetrieveIRQSmpAffinity(dir, 26)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000f0"))
+}
+
+func TestExcludeCPUsFromIRQsMovesIRQThreads(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		24: "000000ff",
+		25: "00000006",
+	})
+	defer os.RemoveAll(dir)
+	procDir := createProcDir(g, map[int]string{
+		10: "irq/24-eth0 2129984",
+		11: "irq/25-eth1 2129984",
+		12: "irq/25-s-eth1 2129984",
+	})
+	defer os.RemoveAll(procDir)
+	defer func(dir string) { IRQThreadProcDir = dir }(IRQThreadProcDir)
+	IRQThreadProcDir = procDir
+	affinity := map[int]CPUMask{10: NewCPUMask(0, 1, 2, 3), 11: NewCPUMask(1, 2), 12: NewCPUMask(1, 2)}
+	defer fakeAffinity(affinity)()
+	set := schedSetaffinity
+	schedSetaffinity = func(pid int, cpus CPUMask) error {
+		if pid == 12 {
+			return fmt.Errorf("operation not permitted")
+		}
+		return set(pid, cpus)
+	}
+
+	status, err := ExcludeCPUsFromIRQs("1-2", "000000f9", dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.MovedIRQs()).To(Equal([]int{24, 25}))
+	// handler threads follow their irq, the ones which can't be moved are reported
+	g.Expect(affinity[10].CPUList()).To(Equal("0,3-7"))
+	g.Expect(affinity[11].CPUList()).To(Equal("0,3-7"))
+	g.Expect(affinity[12].CPUList()).To(Equal("1-2"))
+	g.Expect(status.FailedThreadPIDs()).To(Equal([]int{12}))
+}
+
+func TestExcludeCPUsFromIRQsWithoutAffinity(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{24: "00000000,000000ff"})
+	defer os.RemoveAll(dir)
+
+	// irq without smp_affinity file is skipped
+	g.Expect(os.Mkdir(filepath.Join(dir, "0"), 0755)).NotTo(HaveOccurred())
+
+	status, err := ExcludeCPUsFromIRQs("0", "000000fe", dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Moved).To(HaveLen(1))
+	g.Expect(status.Moved).To(HaveKey(24))
+	g.Expect(status.FailedIRQs()).To(BeEmpty())
+}
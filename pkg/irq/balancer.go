@@ -0,0 +1,225 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBalanceInterval interval between two rebalances of the built-in balancer
+const DefaultBalanceInterval = 10 * time.Second
+
+// Balancer is a minimal irq balancer for hosts without irqbalance. It spreads the
+// movable irqs over the online cpus which are not banned, by their observed rate.
+type Balancer struct {
+	irqProcDir     string
+	interruptsFile string
+	interval       time.Duration
+
+	mu         sync.Mutex
+	bannedCPUs CPUMask
+	previous   map[int]uint64
+}
+
+// NewBalancer returns balancer moving irqs found in irqProcDir by their rate sampled
+// from interruptsFile
+func NewBalancer(irqProcDir, interruptsFile string, interval time.Duration) *Balancer {
+	return &Balancer{
+		irqProcDir:     irqProcDir,
+		interruptsFile: interruptsFile,
+		interval:       interval,
+		bannedCPUs:     NewCPUMask(),
+	}
+}
+
+// SetBannedCPUs bans the cpus in given mask and rebalances the irqs right away
+func (b *Balancer) SetBannedCPUs(bannedCPUMask string) error {
+	bannedmask, err := ParseCPUMask(bannedCPUMask)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.bannedCPUs = bannedmask
+	b.mu.Unlock()
+	logrus.Infof("built-in balancer banned cpus are set to %s", bannedmask.CPUList())
+	return b.Rebalance()
+}
+
+// Run rebalances the irqs in every interval until stop channel is closed, the irqs
+// are balanced only when banned cpus are set if the interval isn't positive.
+func (b *Balancer) Run(stop <-chan struct{}) {
+	if b.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := b.Rebalance(); err != nil {
+				logrus.Errorf("error rebalancing irqs: %v", err)
+			}
+		}
+	}
+}
+
+// rebalanceThreshold is the load imbalance, relative to the busier cpu, above which
+// an irq already pinned to a housekeeping cpu is moved to the least loaded cpu.
+const rebalanceThreshold = 0.25
+
+// Rebalance assigns every movable irq to a single housekeeping cpu, the busiest irqs
+// first to the least loaded cpu. An irq whose affinity is entirely within the banned
+// cpus is deliberately pinned there and left alone. An irq already pinned to a single
+// housekeeping cpu stays there unless its cpu is loaded more than rebalanceThreshold
+// above the least loaded cpu and the move lowers the busier load, so that the irqs
+// don't bounce between the cpus on every small change of their rates.
+func (b *Balancer) Rebalance() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	interrupts, err := ReadInterrupts(b.interruptsFile)
+	if err != nil {
+		return err
+	}
+	housekeeping := NewCPUMask(interrupts.CPUs...).Difference(b.bannedCPUs)
+	if housekeeping.IsEmpty() {
+		return fmt.Errorf("all online cpus %v are banned", interrupts.CPUs)
+	}
+
+	irqs, rates := b.sampleRates(interrupts)
+	sort.SliceStable(irqs, func(i, j int) bool { return rates[irqs[i]] > rates[irqs[j]] })
+
+	load := make(map[int]uint64)
+	count := make(map[int]int)
+	// cpu of the irqs pinned to a single housekeeping cpu
+	pinned := make(map[int]int)
+	var unpinned []int
+	widths := make(map[int]int)
+	for _, irq := range irqs {
+		current, err := RetrieveIRQSmpAffinity(b.irqProcDir, irq)
+		if err != nil {
+			// irq without smp_affinity (e.g. irq 0) can't be moved
+			continue
+		}
+		currentmask, err := ParseCPUMask(current)
+		if err != nil {
+			logrus.Warnf("invalid smp affinity %s of irq %d: %v", current, irq, err)
+			continue
+		}
+		if !currentmask.IsEmpty() && currentmask.IsSubsetOf(b.bannedCPUs) {
+			continue
+		}
+		widths[irq] = maskWidth(current)
+		if cpus := currentmask.CPUSet(); cpus.Size() == 1 && currentmask.IsSubsetOf(housekeeping) {
+			cpu := cpus.ToSlice()[0]
+			pinned[irq] = cpu
+			load[cpu] += rates[irq]
+			count[cpu]++
+			continue
+		}
+		unpinned = append(unpinned, irq)
+	}
+
+	var moved []int
+	threads := listIRQThreads()
+	status := newIRQAffinityStatus()
+	move := func(irq, target int) bool {
+		mask := NewCPUMask(target).Format(widths[irq])
+		if err := writeIRQSmpAffinity(b.irqProcDir, irq, mask); err != nil {
+			// managed irqs refuse affinity changes
+			logrus.Debugf("irq %d can't be moved to cpu %d: %v", irq, target, err)
+			return false
+		}
+		moved = append(moved, irq)
+		threads.follow(irq, mask, status)
+		return true
+	}
+	for _, irq := range unpinned {
+		target := leastLoadedCPU(housekeeping, load, count)
+		if !move(irq, target) {
+			continue
+		}
+		load[target] += rates[irq]
+		count[target]++
+	}
+	for _, irq := range irqs {
+		cpu, ok := pinned[irq]
+		if !ok {
+			continue
+		}
+		target := leastLoadedCPU(housekeeping, load, count)
+		imbalance := load[cpu] - load[target]
+		if target == cpu || float64(imbalance) <= rebalanceThreshold*float64(load[cpu]) ||
+			load[target]+rates[irq] >= load[cpu] {
+			continue
+		}
+		if !move(irq, target) {
+			continue
+		}
+		load[cpu] -= rates[irq]
+		count[cpu]--
+		load[target] += rates[irq]
+		count[target]++
+	}
+	if len(moved) > 0 {
+		logrus.Infof("built-in balancer moved irqs %v over housekeeping cpus %s", moved, housekeeping.CPUList())
+	}
+	for _, pid := range status.FailedThreadPIDs() {
+		logrus.Warnf("built-in balancer couldn't move threaded irq handler %d: %v", pid, status.FailedThreads[pid])
+	}
+	return nil
+}
+
+// sampleRates returns the irqs and their interrupt count since the previous sample,
+// the total count when there is no previous sample.
+func (b *Balancer) sampleRates(interrupts *Interrupts) ([]int, map[int]uint64) {
+	var irqs []int
+	rates := make(map[int]uint64)
+	totals := make(map[int]uint64)
+	for _, line := range interrupts.Lines {
+		irq, ok := line.IRQ()
+		if !ok {
+			continue
+		}
+		irqs = append(irqs, irq)
+		totals[irq] = line.Total()
+		rates[irq] = totals[irq]
+		if previous, ok := b.previous[irq]; ok && previous <= totals[irq] {
+			rates[irq] = totals[irq] - previous
+		}
+	}
+	b.previous = totals
+	return irqs, rates
+}
+
+func leastLoadedCPU(cpus CPUMask, load map[int]uint64, count map[int]int) int {
+	slice := cpus.CPUSet().ToSlice()
+	target := slice[0]
+	for _, cpu := range slice[1:] {
+		if load[cpu] < load[target] || (load[cpu] == load[target] && count[cpu] < count[target]) {
+			target = cpu
+		}
+	}
+	return target
+}
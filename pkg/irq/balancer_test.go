@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestBalancerRebalance(t *testing.T) {
+	g := NewGomegaWithT(t)
+	irqProcDir := createIRQProcDir(g, map[int]string{
+		30: "0000000f",
+		31: "0000000f",
+		32: "0000000f",
+		// pinned to an isolated cpu on purpose
+		33: "00000004",
+	})
+	defer os.RemoveAll(irqProcDir)
+	interruptsFile := writeInterruptsFile(g, irqProcDir, `           CPU0       CPU1       CPU2       CPU3
+ 30:        500        500          0          0   PCI-MSI   0-edge      eth0
+ 31:        100          0          0          0   PCI-MSI   1-edge      eth1
+ 32:         50          0          0          0   PCI-MSI   2-edge      eth2
+ 33:          0          0         10          0   PCI-MSI   3-edge      eth3
+LOC:       1000       2000       3000       4000   Local timer interrupts
+`)
+
+	balancer := NewBalancer(irqProcDir, interruptsFile, time.Minute)
+	g.Expect(balancer.SetBannedCPUs("00000006")).NotTo(HaveOccurred())
+
+	expected := map[int]string{30: "00000001", 31: "00000008", 32: "00000008", 33: "00000004"}
+	for irq, mask := range expected {
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(current).To(Equal(mask), "irq %d", irq)
+	}
+
+	// eth1 gets busy since the previous sample
+	writeInterruptsFile(g, irqProcDir, `           CPU0       CPU1       CPU2       CPU3
+ 30:        510        500          0          0   PCI-MSI   0-edge      eth0
+ 31:       1100          0          0          0   PCI-MSI   1-edge      eth1
+ 32:         60          0          0          0   PCI-MSI   2-edge      eth2
+ 33:          0          0         10          0   PCI-MSI   3-edge      eth3
+`)
+	g.Expect(balancer.Rebalance()).NotTo(HaveOccurred())
+	// eth1 stays, moving eth2 is enough to even out the load
+	expected = map[int]string{30: "00000001", 31: "00000008", 32: "00000001"}
+	for irq, mask := range expected {
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(current).To(Equal(mask), "irq %d", irq)
+	}
+
+	// small imbalance below the threshold moves nothing
+	writeInterruptsFile(g, irqProcDir, `           CPU0       CPU1       CPU2       CPU3
+ 30:        520        500          0          0   PCI-MSI   0-edge      eth0
+ 31:       1109          0          0          0   PCI-MSI   1-edge      eth1
+ 32:         61          0          0          0   PCI-MSI   2-edge      eth2
+ 33:          0          0         10          0   PCI-MSI   3-edge      eth3
+`)
+	g.Expect(balancer.Rebalance()).NotTo(HaveOccurred())
+	for irq, mask := range expected {
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(current).To(Equal(mask), "irq %d", irq)
+	}
+
+	g.Expect(balancer.SetBannedCPUs("0000000f")).To(HaveOccurred())
+}
+
+func TestBalancerRunWithoutInterval(t *testing.T) {
+	g := NewGomegaWithT(t)
+	balancer := NewBalancer("", "", 0)
+	stopped := make(chan struct{})
+	go func() {
+		balancer.Run(make(chan struct{}))
+		close(stopped)
+	}()
+	g.Eventually(stopped).Should(BeClosed())
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+// cpuMaskWordBits number of cpus in each comma separated word of a kernel cpu mask
+const cpuMaskWordBits = 32
+
+// CPUMask set of cpus, parsed from and formatted into kernel cpu mask syntaxes: hex
+// words separated by comma (e.g. 00000000,0000001f) and cpulist (e.g. 0-4)
+type CPUMask struct {
+	cpus cpuset.CPUSet
+}
+
+// NewCPUMask returns cpu mask containing given cpus
+func NewCPUMask(cpus ...int) CPUMask {
+	return CPUMask{cpus: cpuset.NewCPUSet(cpus...)}
+}
+
+// NewCPUMaskFromCPUSet returns cpu mask containing cpus of given cpuset
+func NewCPUMaskFromCPUSet(cpus cpuset.CPUSet) CPUMask {
+	return CPUMask{cpus: cpus}
+}
+
+// ParseCPUMask parses hex cpu mask, with or without the commas between the words
+func ParseCPUMask(mask string) (CPUMask, error) {
+	s := strings.ReplaceAll(strings.TrimSpace(mask), ",", "")
+	b := cpuset.NewBuilder()
+	for i := 0; i < len(s); i++ {
+		digit, err := strconv.ParseUint(s[len(s)-1-i:len(s)-i], 16, 8)
+		if err != nil {
+			return CPUMask{cpus: cpuset.NewCPUSet()}, fmt.Errorf("invalid cpu mask %q", mask)
+		}
+		for bit := 0; bit < 4; bit++ {
+			if digit&(1<<uint(bit)) != 0 {
+				b.Add(i*4 + bit)
+			}
+		}
+	}
+	return CPUMask{cpus: b.Result()}, nil
+}
+
+// ParseCPUList parses cpulist such as 0-2,5
+func ParseCPUList(list string) (CPUMask, error) {
+	cpus, err := cpuset.Parse(strings.TrimSpace(list))
+	if err != nil {
+		return CPUMask{cpus: cpuset.NewCPUSet()}, err
+	}
+	return CPUMask{cpus: cpus}, nil
+}
+
+// String returns the mask in hex words separated by comma, as wide as needed
+func (m CPUMask) String() string {
+	return m.Format(0)
+}
+
+// Format returns the mask in hex words separated by comma, wide enough for width cpus
+// and for all cpus in the mask
+func (m CPUMask) Format(width int) string {
+	if cpus := m.cpus.ToSlice(); len(cpus) > 0 && cpus[len(cpus)-1] >= width {
+		width = cpus[len(cpus)-1] + 1
+	}
+	words := make([]uint32, (width+cpuMaskWordBits-1)/cpuMaskWordBits)
+	if len(words) == 0 {
+		words = make([]uint32, 1)
+	}
+	for _, cpu := range m.cpus.ToSlice() {
+		words[cpu/cpuMaskWordBits] |= 1 << uint(cpu%cpuMaskWordBits)
+	}
+	formatted := make([]string, len(words))
+	for i, word := range words {
+		formatted[len(words)-1-i] = fmt.Sprintf("%08x", word)
+	}
+	return strings.Join(formatted, ",")
+}
+
+// CPUList returns the mask in cpulist syntax
+func (m CPUMask) CPUList() string {
+	return m.cpus.String()
+}
+
+// CPUSet returns cpus of the mask
+func (m CPUMask) CPUSet() cpuset.CPUSet {
+	return m.cpus
+}
+
+// IsEmpty returns true if the mask contains no cpu
+func (m CPUMask) IsEmpty() bool {
+	return m.cpus.IsEmpty()
+}
+
+// Equals returns true if both masks contain the same cpus
+func (m CPUMask) Equals(other CPUMask) bool {
+	return m.cpus.Equals(other.cpus)
+}
+
+// IsSubsetOf returns true if other mask contains all cpus of the mask
+func (m CPUMask) IsSubsetOf(other CPUMask) bool {
+	return m.cpus.IsSubsetOf(other.cpus)
+}
+
+// Union returns cpus in either of the masks
+func (m CPUMask) Union(other CPUMask) CPUMask {
+	return CPUMask{cpus: m.cpus.Union(other.cpus)}
+}
+
+// Intersection returns cpus in both masks
+func (m CPUMask) Intersection(other CPUMask) CPUMask {
+	return CPUMask{cpus: m.cpus.Intersection(other.cpus)}
+}
+
+// Difference returns cpus in the mask but not in other mask
+func (m CPUMask) Difference(other CPUMask) CPUMask {
+	return CPUMask{cpus: m.cpus.Difference(other.cpus)}
+}
+
+// Complement returns cpus of given universe, e.g. online cpus, which are not in the mask
+func (m CPUMask) Complement(universe CPUMask) CPUMask {
+	return universe.Difference(m)
+}
+
+// maskWidth returns number of cpus the given hex mask can hold
+func maskWidth(mask string) int {
+	return len(strings.ReplaceAll(strings.TrimSpace(mask), ",", "")) * 4
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseCPUMask(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mask, err := ParseCPUMask("00000001,00000106\n")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask.CPUList()).To(Equal("1-2,8,32"))
+	g.Expect(mask.String()).To(Equal("00000001,00000106"))
+
+	mask, err = ParseCPUMask("f")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask.CPUList()).To(Equal("0-3"))
+	g.Expect(mask.Format(64)).To(Equal("00000000,0000000f"))
+
+	mask, err = ParseCPUMask("")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask.IsEmpty()).To(BeTrue())
+	g.Expect(mask.String()).To(Equal("00000000"))
+
+	_, err = ParseCPUMask("0000000g")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestCPUMaskWiderThan64CPUs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mask, err := ParseCPUList("0,70,127")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask.String()).To(Equal("80000000,00000040,00000000,00000001"))
+
+	parsed, err := ParseCPUMask(mask.String())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(parsed.Equals(mask)).To(BeTrue())
+}
+
+func TestCPUMaskSetOperations(t *testing.T) {
+	g := NewGomegaWithT(t)
+	a := NewCPUMask(0, 1, 2, 3)
+	b := NewCPUMask(2, 3, 4)
+	g.Expect(a.Union(b).CPUList()).To(Equal("0-4"))
+	g.Expect(a.Intersection(b).CPUList()).To(Equal("2-3"))
+	g.Expect(a.Difference(b).CPUList()).To(Equal("0-1"))
+	g.Expect(a.Complement(NewCPUMask(0, 1, 2, 3, 4, 5)).CPUList()).To(Equal("4-5"))
+	g.Expect(NewCPUMask(2).IsSubsetOf(b)).To(BeTrue())
+}
+
+func TestInvertMaskStringWithComma(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-39", "0-39")()
+
+	inverted, err := InvertMaskStringWithComma("000000ff,fffffff9")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(inverted).To(Equal("00000000,00000006"))
+
+	// bits above the online cpus never get set
+	inverted, err = InvertMaskStringWithComma("00000000,00000000")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(inverted).To(Equal("000000ff,ffffffff"))
+}
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"strings"
 
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	"k8s.io/kubernetes/pkg/kubelet/checkpointmanager"
 	"k8s.io/kubernetes/pkg/kubelet/cm/cpumanager"
@@ -35,6 +36,8 @@ const (
 type CPUManagerService interface {
 	GetAssignedCpus(podUID string) (string, error)
 	GetAssignedCpusFromCache(podUID string) string
+	GetAssignedContainerCpusFromCache(podUID string) map[string]string
+	GetAllAssignedCpusFromCache() map[string]string
 	Remove(podUID string)
 }
 
@@ -47,6 +50,7 @@ type cpuState struct {
 // GetAssignedCpus get allocated cpu cores for given Guaranteed QoS pod uid
 func (cs *cpuState) GetAssignedCpus(podUID string) (string, error) {
 	if err := cs.restoreState(); err != nil {
+		metrics.CheckpointReadErrors.Inc()
 		return "", err
 	}
 	return cs.GetAssignedCpusFromCache(podUID), nil
@@ -62,6 +66,34 @@ func (cs *cpuState) GetAssignedCpusFromCache(podUID string) string {
 	return cs.getCPUsFromCheckpointV2(podUID)
 }
 
+// GetAssignedContainerCpusFromCache get allocated cpu cores per container for given
+// Guaranteed QoS pod uid. v1 checkpoint doesn't carry container names, so all the pod
+// cpus are returned for the empty container name.
+func (cs *cpuState) GetAssignedContainerCpusFromCache(podUID string) map[string]string {
+	containerCPUs := make(map[string]string)
+	if cpus := cs.getCPUsFromCheckpointV1(podUID); cpus != "" {
+		containerCPUs[""] = cpus
+		return containerCPUs
+	}
+	for containerName, cpus := range cs.EntriesV2[podUID] {
+		containerCPUs[containerName] = cpus
+	}
+	return containerCPUs
+}
+
+// GetAllAssignedCpusFromCache get allocated cpu cores of every Guaranteed QoS pod keyed
+// by pod uid, cpus not there are in the shared pool.
+func (cs *cpuState) GetAllAssignedCpusFromCache() map[string]string {
+	podCPUs := make(map[string]string)
+	for podUID := range cs.EntriesV1 {
+		podCPUs[podUID] = cs.GetAssignedCpusFromCache(podUID)
+	}
+	for podUID := range cs.EntriesV2 {
+		podCPUs[podUID] = cs.GetAssignedCpusFromCache(podUID)
+	}
+	return podCPUs
+}
+
 // Remove delete entries for podUID from the V* map. could be useful in
 // pod delete scenarios.
 func (cs *cpuState) Remove(podUID string) {
@@ -45,6 +45,8 @@ func TestNewCPUManagerV1(t *testing.T) {
 	cms, err := NewCPUManagerServiceWithEntries(cacheV1, nil)
 	g.Expect(err).NotTo(HaveOccurred())
 	g.Expect(cms.GetAssignedCpusFromCache("8631b3ef-066d-4723-a4b2-797d9d095c4f")).To(Equal(c1AssignedCPUs))
+	g.Expect(cms.GetAssignedContainerCpusFromCache("8631b3ef-066d-4723-a4b2-797d9d095c4f")).To(Equal(
+		map[string]string{"": c1AssignedCPUs}))
 	cms.Remove("8631b3ef-066d-4723-a4b2-797d9d095c4f")
 	g.Expect(cms.GetAssignedCpusFromCache("8631b3ef-066d-4723-a4b2-797d9d095c4f")).To(Equal(""))
 }
@@ -60,8 +62,13 @@ func TestNewCPUManagerV2(t *testing.T) {
 	cms, err := NewCPUManagerServiceWithEntries(nil, cacheV2)
 	g.Expect(err).NotTo(HaveOccurred())
 	g.Expect(cms.GetAssignedCpusFromCache("8631b3ef-066d-4723-a4b2-797d9d095c4f")).To(Equal(c1AssignedCPUs))
+	g.Expect(cms.GetAllAssignedCpusFromCache()).To(HaveLen(2))
 	cms.Remove("8631b3ef-066d-4723-a4b2-797d9d095c4f")
 	g.Expect(cms.GetAssignedCpusFromCache("8631b3ef-066d-4723-a4b2-797d9d095c4f")).To(Equal(""))
+	g.Expect(cms.GetAllAssignedCpusFromCache()).To(HaveKey("9631b3ef-066d-4723-a4b2-797d9d095c50"))
+	g.Expect(cms.GetAllAssignedCpusFromCache()).To(HaveLen(1))
+	g.Expect(cms.GetAssignedContainerCpusFromCache("9631b3ef-066d-4723-a4b2-797d9d095c50")).To(Equal(
+		map[string]string{"busybox1": c2AssignedCPUs, "busybox2": c3AssignedCPUs}))
 	g.Expect(cms.GetAssignedCpusFromCache("9631b3ef-066d-4723-a4b2-797d9d095c50")).To(ContainSubstring(c2AssignedCPUs))
 	g.Expect(cms.GetAssignedCpusFromCache("9631b3ef-066d-4723-a4b2-797d9d095c50")).To(ContainSubstring(c3AssignedCPUs))
 }
@@ -0,0 +1,152 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResolveDeviceIRQs returns sorted msi irqs of given devices, named by pci address
+// (e.g. 0000:3b:02.1) or by network interface name
+func ResolveDeviceIRQs(pciDir, netDir string, devices []string) ([]int, error) {
+	var irqs []int
+	for _, device := range devices {
+		address, err := resolvePCIAddress(pciDir, netDir, device)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(pciDir, address, "msi_irqs"))
+		if err != nil {
+			return nil, fmt.Errorf("error listing msi irqs of device %s: %v", device, err)
+		}
+		for _, entry := range entries {
+			if irq, err := strconv.Atoi(entry.Name()); err == nil {
+				irqs = append(irqs, irq)
+			}
+		}
+	}
+	sort.Ints(irqs)
+	return irqs, nil
+}
+
+// PinIRQs sets smp affinity of given irqs to given cpus. IRQs which kernel refused to
+// move are reported in the returned status rather than failing the whole operation.
+func PinIRQs(irqs []int, cpus CPUMask, irqProcDir string) *IRQAffinityStatus {
+	status := newIRQAffinityStatus()
+	threads := listIRQThreads()
+	for _, irq := range irqs {
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		if err != nil {
+			status.Failed[irq] = err
+			continue
+		}
+		newMask := cpus.Format(maskWidth(current))
+		if err := writeIRQSmpAffinity(irqProcDir, irq, newMask); err != nil {
+			status.Failed[irq] = err
+			continue
+		}
+		status.Moved[irq] = IRQAffinityChange{Original: current, Applied: newMask}
+		threads.follow(irq, newMask, status)
+	}
+	return status
+}
+
+// ResolvePodDeviceIRQs returns sorted msi irqs of given devices of the pod. Network
+// interface names are resolved in the pod network namespace, entered through a
+// process of the pod found in procDir, since the interfaces of the pod (e.g. sr-iov
+// vfs) are moved there.
+func ResolvePodDeviceIRQs(pciDir, procDir, podUID string, devices []string) ([]int, error) {
+	names := false
+	for _, device := range devices {
+		if _, err := os.Stat(filepath.Join(pciDir, device)); err != nil {
+			names = true
+			break
+		}
+	}
+	if !names {
+		return ResolveDeviceIRQs(pciDir, "", devices)
+	}
+	pid, err := findPodProcess(procDir, podUID)
+	if err != nil {
+		return nil, err
+	}
+	var irqs []int
+	err = inNetworkNamespace(filepath.Join(procDir, strconv.Itoa(pid), "ns", "net"), func(netDir string) error {
+		irqs, err = ResolveDeviceIRQs(pciDir, netDir, devices)
+		return err
+	})
+	return irqs, err
+}
+
+// findPodProcess returns the lowest pid in procDir running in the cgroup of the pod,
+// named after the pod uid by both cgroupfs and systemd cgroup drivers.
+func findPodProcess(procDir, podUID string) (int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return 0, err
+	}
+	cgroupfs := "pod" + podUID
+	systemd := "pod" + strings.Replace(podUID, "-", "_", -1)
+	pids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		content, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"))
+		if err != nil {
+			// process is gone meanwhile
+			continue
+		}
+		if strings.Contains(string(content), cgroupfs) || strings.Contains(string(content), systemd) {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no process of pod %s found", podUID)
+}
+
+// ParseDevices parses comma separated device list
+func ParseDevices(devices string) []string {
+	var parsed []string
+	for _, device := range strings.Split(devices, ",") {
+		if device = strings.TrimSpace(device); device != "" {
+			parsed = append(parsed, device)
+		}
+	}
+	return parsed
+}
+
+// resolvePCIAddress returns pci address of the device, which is either a pci address
+// itself or a network interface backed by a pci device
+func resolvePCIAddress(pciDir, netDir, device string) (string, error) {
+	if _, err := os.Stat(filepath.Join(pciDir, device)); err == nil {
+		return device, nil
+	}
+	link, err := os.Readlink(filepath.Join(netDir, device, "device"))
+	if err != nil {
+		return "", fmt.Errorf("device %s is neither a pci address nor a pci network interface", device)
+	}
+	return filepath.Base(link), nil
+}
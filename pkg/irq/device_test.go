@@ -0,0 +1,90 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestResolveDeviceIRQs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	nodeDir, pciDir := createNUMADirs(g)
+	defer os.RemoveAll(nodeDir)
+	defer os.RemoveAll(pciDir)
+	g.Expect(os.MkdirAll(filepath.Join(pciDir, "0000:3b:02.1", "msi_irqs"), 0755)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(pciDir, "0000:3b:02.1", "msi_irqs", "40"), []byte("msix\n"), 0644)).NotTo(HaveOccurred())
+
+	netDir, err := ioutil.TempDir("", "net")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(netDir)
+	g.Expect(os.Mkdir(filepath.Join(netDir, "net1"), 0755)).NotTo(HaveOccurred())
+	g.Expect(os.Symlink("../../../0000:3b:02.1", filepath.Join(netDir, "net1", "device"))).NotTo(HaveOccurred())
+
+	irqs, err := ResolveDeviceIRQs(pciDir, netDir, ParseDevices(" net1, 0000:3b:00.0,"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(irqs).To(Equal([]int{30, 31, 40}))
+
+	_, err = ResolveDeviceIRQs(pciDir, netDir, []string{"eth9"})
+	g.Expect(err).To(MatchError("device eth9 is neither a pci address nor a pci network interface"))
+}
+
+func TestResolvePodDeviceIRQs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	nodeDir, pciDir := createNUMADirs(g)
+	defer os.RemoveAll(nodeDir)
+	defer os.RemoveAll(pciDir)
+	procDir := createProcDir(g, map[int]string{1: "systemd 0", 4021: "pause 0", 4107: "testpmd 0"})
+	defer os.RemoveAll(procDir)
+	for pid, cgroup := range map[int]string{
+		1:    "0::/init.scope\n",
+		4021: "0::/kubepods.slice/kubepods-pod6f1e_2b4c.slice/cri-containerd-f00.scope\n",
+		4107: "0::/kubepods.slice/kubepods-pod6f1e_2b4c.slice/cri-containerd-ba5.scope\n",
+	} {
+		g.Expect(ioutil.WriteFile(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"), []byte(cgroup), 0644)).NotTo(HaveOccurred())
+	}
+
+	pid, err := findPodProcess(procDir, "6f1e-2b4c")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pid).To(Equal(4021))
+	_, err = findPodProcess(procDir, "9a9a-0000")
+	g.Expect(err).To(MatchError("no process of pod 9a9a-0000 found"))
+
+	// pci addresses don't need the pod network namespace
+	irqs, err := ResolvePodDeviceIRQs(pciDir, procDir, "9a9a-0000", []string{"0000:3b:00.0"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(irqs).To(Equal([]int{30, 31}))
+	_, err = ResolvePodDeviceIRQs(pciDir, procDir, "9a9a-0000", []string{"net1"})
+	g.Expect(err).To(MatchError("no process of pod 9a9a-0000 found"))
+}
+
+func TestPinIRQs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{30: "00000000,000000ff"})
+	defer os.RemoveAll(dir)
+
+	status := PinIRQs([]int{30, 31}, NewCPUMask(2, 3), dir)
+	g.Expect(status.Moved).To(Equal(map[int]IRQAffinityChange{
+		30: {Original: "00000000,000000ff", Applied: "00000000,0000000c"},
+	}))
+	g.Expect(status.FailedIRQs()).To(Equal([]int{31}))
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// DriftMode decides what happens when a live mask drifts from the desired state
+type DriftMode string
+
+const (
+	// DriftModeOff disables drift verification
+	DriftModeOff DriftMode = "off"
+	// DriftModeReport only logs and counts the divergences, for clusters where
+	// another tool owns the masks
+	DriftModeReport DriftMode = "report"
+	// DriftModeRepair logs, counts and rewrites the diverged masks
+	DriftModeRepair DriftMode = "repair"
+)
+
+// ParseDriftMode returns drift mode for the given string
+func ParseDriftMode(mode string) (DriftMode, error) {
+	switch DriftMode(mode) {
+	case DriftModeOff, DriftModeReport, DriftModeRepair:
+		return DriftMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid drift mode %s, must be one of %s, %s or %s", mode,
+		DriftModeOff, DriftModeReport, DriftModeRepair)
+}
+
+// DriftCheck verifies a single irq mask setting
+type DriftCheck struct {
+	// Name of the setting, reported in logs
+	Name string
+	// Read returns the live and the desired value of the setting
+	Read func() (live, desired string, err error)
+	// Repair brings the setting back to the desired value
+	Repair func(desired string) error
+}
+
+// DriftVerifier periodically compares live irq masks with the desired state
+type DriftVerifier struct {
+	mode     DriftMode
+	interval time.Duration
+	lock     sync.Locker
+	checks   []DriftCheck
+}
+
+// NewDriftVerifier returns drift verifier running given checks in every interval.
+// checks run holding the lock when it's not nil, so that repairs don't race with
+// the other writers of the same masks.
+func NewDriftVerifier(mode DriftMode, interval time.Duration, lock sync.Locker, checks ...DriftCheck) *DriftVerifier {
+	return &DriftVerifier{
+		mode:     mode,
+		interval: interval,
+		lock:     lock,
+		checks:   checks,
+	}
+}
+
+// Run verifies the checks in every interval until stop channel is closed
+func (v *DriftVerifier) Run(stop <-chan struct{}) {
+	if v.mode == DriftModeOff || v.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			v.Verify()
+		}
+	}
+}
+
+// Verify runs all the checks once, returns the names of diverged settings
+func (v *DriftVerifier) Verify() []string {
+	if v.lock != nil {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+	}
+	var diverged []string
+	for _, check := range v.checks {
+		live, desired, err := check.Read()
+		if err != nil {
+			logrus.Warnf("drift check of %s failed: %v", check.Name, err)
+			continue
+		}
+		if masksEqual(live, desired) {
+			continue
+		}
+		diverged = append(diverged, check.Name)
+		metrics.DriftDivergences.WithLabelValues(check.Name).Inc()
+		logrus.Warnf("%s drifted from %s to %s", check.Name, desired, live)
+		if v.mode != DriftModeRepair || check.Repair == nil {
+			continue
+		}
+		if err := check.Repair(desired); err != nil {
+			logrus.Errorf("error repairing %s to %s: %v", check.Name, desired, err)
+			continue
+		}
+		logrus.Infof("%s is repaired to %s", check.Name, desired)
+	}
+	return diverged
+}
+
+// masksEqual compares two masks by the cpus they contain, ignoring the width.
+// values which are not masks are compared as they are.
+func masksEqual(a, b string) bool {
+	if a == b {
+		return true
+	}
+	amask, err := ParseCPUMask(a)
+	if err != nil {
+		return false
+	}
+	bmask, err := ParseCPUMask(b)
+	if err != nil {
+		return false
+	}
+	return amask.Equals(bmask)
+}
+
+// NewSmpAffinityDriftChecks returns drift checks of the default smp affinity and the
+// pod banned cpus files, both expected to exclude the cpus returned by excludedCPUs
+// as ApplyIRQLoadBalancing does. The other cpus of the default smp affinity aren't
+// verified, those may be owned by the administrator or another tool.
+func NewSmpAffinityDriftChecks(excludedCPUs func() string, irqSmpAffinityFile, podIrqBannedCPUsFile string) []DriftCheck {
+	desiredMasks := func() (cpuMask, bannedCPUMask string, err error) {
+		current, err := RetrieveCPUMask(irqSmpAffinityFile)
+		if err != nil {
+			return "", "", err
+		}
+		return desiredIRQMasks(excludedCPUs(), current)
+	}
+	repair := func(string) error {
+		return ApplyIRQLoadBalancing(excludedCPUs(), irqSmpAffinityFile, podIrqBannedCPUsFile)
+	}
+	return []DriftCheck{
+		{
+			Name: irqSmpAffinityFile,
+			Read: func() (live, desired string, err error) {
+				if live, err = RetrieveCPUMask(irqSmpAffinityFile); err != nil {
+					return "", "", err
+				}
+				desired, _, err = desiredMasks()
+				return live, desired, err
+			},
+			Repair: repair,
+		},
+		{
+			Name: podIrqBannedCPUsFile,
+			Read: func() (live, desired string, err error) {
+				if live, err = RetrieveCPUMask(podIrqBannedCPUsFile); err != nil {
+					return "", "", err
+				}
+				_, desired, err = desiredMasks()
+				return live, desired, err
+			},
+			Repair: repair,
+		},
+	}
+}
+
+// NewIRQBalanceConfigDriftCheck returns drift check of the banned cpus in irqbalance
+// config file, repairing it restarts irqbalance with the desired banned cpus.
+func NewIRQBalanceConfigDriftCheck(config IRQBalanceConfig, desiredBannedCPUs func() (string, error)) DriftCheck {
+	return DriftCheck{
+		Name: config.File,
+		Read: func() (live, desired string, err error) {
+			if live, err = RetrieveIRQBalanceBannedCPUs(config); err != nil {
+				return "", "", err
+			}
+			desired, err = desiredBannedCPUs()
+			return live, desired, err
+		},
+		Repair: func(desired string) error {
+			return ResetIRQBalance(config, desired)
+		},
+	}
+}
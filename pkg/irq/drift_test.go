@@ -0,0 +1,162 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseDriftMode(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mode, err := ParseDriftMode("repair")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mode).To(Equal(DriftModeRepair))
+	_, err = ParseDriftMode("fix")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func createDriftFiles(g *WithT) (dir, smpAffinityFile, bannedCPUsFile string) {
+	dir, err := ioutil.TempDir("", "drift")
+	g.Expect(err).NotTo(HaveOccurred())
+	smpAffinityFile = filepath.Join(dir, "default_smp_affinity")
+	bannedCPUsFile = filepath.Join(dir, "pod_irq_banned_cpus")
+	g.Expect(ioutil.WriteFile(smpAffinityFile, []byte("00000000,000000f9"), 0644)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(bannedCPUsFile, []byte("00000000,00000006"), 0644)).NotTo(HaveOccurred())
+	return dir, smpAffinityFile, bannedCPUsFile
+}
+
+func TestDriftVerifierReport(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, smpAffinityFile, bannedCPUsFile := createDriftFiles(g)
+	defer os.RemoveAll(dir)
+	defer setCPUTopology(g, "0-63", "0-7")()
+
+	isolatedCPUs := func() string { return "1-2" }
+	verifier := NewDriftVerifier(DriftModeReport, time.Minute, nil,
+		NewSmpAffinityDriftChecks(isolatedCPUs, smpAffinityFile, bannedCPUsFile)...)
+	g.Expect(verifier.Verify()).To(BeEmpty())
+
+	// tuned resets the default smp affinity
+	g.Expect(ioutil.WriteFile(smpAffinityFile, []byte("00000000,000000ff"), 0644)).NotTo(HaveOccurred())
+	g.Expect(verifier.Verify()).To(Equal([]string{smpAffinityFile}))
+	// somebody else rewrites pod banned cpus too
+	g.Expect(ioutil.WriteFile(bannedCPUsFile, []byte("00000000,00000000"), 0644)).NotTo(HaveOccurred())
+	g.Expect(verifier.Verify()).To(Equal([]string{smpAffinityFile, bannedCPUsFile}))
+	g.Expect(testutil.ToFloat64(metrics.DriftDivergences.WithLabelValues(smpAffinityFile))).To(Equal(2.0))
+	g.Expect(testutil.ToFloat64(metrics.DriftDivergences.WithLabelValues(bannedCPUsFile))).To(Equal(1.0))
+
+	mask, err := RetrieveCPUMask(smpAffinityFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000ff"))
+}
+
+func TestDriftVerifierRepair(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, smpAffinityFile, bannedCPUsFile := createDriftFiles(g)
+	defer os.RemoveAll(dir)
+	defer setCPUTopology(g, "0-63", "0-7")()
+
+	isolatedCPUs := func() string { return "1-2" }
+	verifier := NewDriftVerifier(DriftModeRepair, time.Minute, nil,
+		NewSmpAffinityDriftChecks(isolatedCPUs, smpAffinityFile, bannedCPUsFile)...)
+
+	g.Expect(ioutil.WriteFile(smpAffinityFile, []byte("00000000,000000ff"), 0644)).NotTo(HaveOccurred())
+	g.Expect(verifier.Verify()).To(HaveLen(1))
+	g.Expect(verifier.Verify()).To(BeEmpty())
+
+	mask, err := RetrieveCPUMask(smpAffinityFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000f9"))
+}
+
+func TestDriftVerifierKeepsCPUsBannedByOthers(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, smpAffinityFile, bannedCPUsFile := createDriftFiles(g)
+	defer os.RemoveAll(dir)
+	defer setCPUTopology(g, "0-63", "0-7")()
+
+	// cpu 3 is banned by administrator, which isn't a drift
+	g.Expect(ioutil.WriteFile(smpAffinityFile, []byte("00000000,000000f1"), 0644)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(bannedCPUsFile, []byte("00000000,0000000e"), 0644)).NotTo(HaveOccurred())
+	isolatedCPUs := func() string { return "1-2" }
+	verifier := NewDriftVerifier(DriftModeRepair, time.Minute, nil,
+		NewSmpAffinityDriftChecks(isolatedCPUs, smpAffinityFile, bannedCPUsFile)...)
+	g.Expect(verifier.Verify()).To(BeEmpty())
+
+	// isolated cpu 1 is added back, which is
+	g.Expect(ioutil.WriteFile(smpAffinityFile, []byte("00000000,000000f3"), 0644)).NotTo(HaveOccurred())
+	g.Expect(verifier.Verify()).To(Equal([]string{smpAffinityFile}))
+
+	mask, err := RetrieveCPUMask(smpAffinityFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000f1"))
+}
+
+func TestDriftVerifierLock(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, smpAffinityFile, bannedCPUsFile := createDriftFiles(g)
+	defer os.RemoveAll(dir)
+	defer setCPUTopology(g, "0-63", "0-7")()
+
+	lock := &sync.Mutex{}
+	isolatedCPUs := func() string { return "1-2" }
+	verifier := NewDriftVerifier(DriftModeRepair, time.Minute, lock,
+		NewSmpAffinityDriftChecks(isolatedCPUs, smpAffinityFile, bannedCPUsFile)...)
+
+	lock.Lock()
+	verified := make(chan []string)
+	go func() { verified <- verifier.Verify() }()
+	g.Consistently(verified, 100*time.Millisecond).ShouldNot(Receive())
+	lock.Unlock()
+	g.Eventually(verified).Should(Receive(BeEmpty()))
+}
+
+func TestDriftVerifierRunWithoutInterval(t *testing.T) {
+	g := NewGomegaWithT(t)
+	verifier := NewDriftVerifier(DriftModeReport, 0, nil)
+	stopped := make(chan struct{})
+	go func() {
+		verifier.Run(make(chan struct{}))
+		close(stopped)
+	}()
+	g.Eventually(stopped).Should(BeClosed())
+}
+
+func TestIRQBalanceConfigDriftCheck(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "drift")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "irqbalance")
+	g.Expect(ioutil.WriteFile(configFile, []byte("IRQBALANCE_ONESHOT=\nIRQBALANCE_BANNED_CPUS=\"00000006\"\n"), 0644)).
+		NotTo(HaveOccurred())
+
+	check := NewIRQBalanceConfigDriftCheck(IRQBalanceConfig{File: configFile}, func() (string, error) { return "00000000,00000006", nil })
+	live, desired, err := check.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(live).To(Equal("00000006"))
+	g.Expect(masksEqual(live, desired)).To(BeTrue())
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HostCgroupDir cgroup directory of the host
+	HostCgroupDir = "/host/sys/fs/cgroup"
+	// HousekeepingAffinityStoreFile file containing original affinity of kernel threads
+	// and host service cgroups
+	HousekeepingAffinityStoreFile = IrqSmpBalanceStateDir + "/housekeeping_affinity"
+
+	cpusetCPUsFileName          = "cpuset.cpus"
+	cpusetEffectiveCPUsFileName = "cpuset.cpus.effective"
+	// irqThreadPrefix comm prefix of threaded irq handlers, those follow their irq
+	irqThreadPrefix = "irq/"
+)
+
+// HostServiceCgroups cgroups of the host services kept on housekeeping cpus
+var HostServiceCgroups = []string{"system.slice", "init.scope"}
+
+// KthreadAffinity original affinity of a kernel thread
+type KthreadAffinity struct {
+	Comm     string `json:"comm"`
+	Original string `json:"original"`
+}
+
+// HousekeepingAffinityStatus outcome of changing affinity of kernel threads and cgroups
+type HousekeepingAffinityStatus struct {
+	// Kthreads pids of the kernel threads whose affinity was changed
+	Kthreads []int
+	// Cgroups cgroups whose cpuset was changed
+	Cgroups []string
+	// Failed kernel threads and cgroups which couldn't be changed
+	Failed map[string]error
+}
+
+// HousekeepingAffinityStore keeps movable kernel threads and host service cgroups off
+// the banned cpus, and keeps their original affinity in a file to restore it later.
+type HousekeepingAffinityStore struct {
+	mu        sync.Mutex
+	procDir   string
+	cgroupDir string
+	file      string
+	// Kthreads maps pid of kernel threads to their original affinity
+	Kthreads map[int]KthreadAffinity `json:"kthreads"`
+	// Cgroups maps cgroup relative to the cpuset hierarchy to its original cpuset.cpus,
+	// empty for the ones inheriting the parent cpus on cgroup v2
+	Cgroups map[string]string `json:"cgroups"`
+}
+
+// NewHousekeepingAffinityStore returns store for the kernel threads in procDir and the
+// host service cgroups in cgroupDir backed by given file, loading the original
+// affinities recorded by previous run if any.
+func NewHousekeepingAffinityStore(procDir, cgroupDir, file string) (*HousekeepingAffinityStore, error) {
+	s := &HousekeepingAffinityStore{
+		procDir:   procDir,
+		cgroupDir: cgroupDir,
+		file:      file,
+		Kthreads:  make(map[int]KthreadAffinity),
+		Cgroups:   make(map[string]string),
+	}
+	if err := readStateFile(file, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Ban removes given cpus from the affinity of movable kernel threads and from the
+// cpuset of host service cgroups. Per-cpu kernel threads, threaded irq handlers and
+// affinities which would be left without cpu are left alone.
+func (s *HousekeepingAffinityStore) Ban(cpus string) (*HousekeepingAffinityStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := &HousekeepingAffinityStatus{Failed: make(map[string]error)}
+	banned, err := ParseCPUList(cpus)
+	if err != nil {
+		return status, err
+	}
+	kthreads, err := ListKthreads(s.procDir)
+	if err != nil {
+		return status, err
+	}
+	for _, kthread := range kthreads {
+		if !kthread.Movable || strings.HasPrefix(kthread.Comm, irqThreadPrefix) {
+			continue
+		}
+		current, err := schedGetaffinity(kthread.PID)
+		if err != nil || current.Intersection(banned).IsEmpty() {
+			continue
+		}
+		updated := current.Difference(banned)
+		if updated.IsEmpty() {
+			continue
+		}
+		if err := schedSetaffinity(kthread.PID, updated); err != nil {
+			status.Failed["kthread/"+strconv.Itoa(kthread.PID)] = err
+			continue
+		}
+		if saved, ok := s.Kthreads[kthread.PID]; !ok || saved.Comm != kthread.Comm {
+			s.Kthreads[kthread.PID] = KthreadAffinity{Comm: kthread.Comm, Original: current.CPUList()}
+		}
+		status.Kthreads = append(status.Kthreads, kthread.PID)
+	}
+
+	cgroups, err := s.listCgroups()
+	if err != nil {
+		return status, err
+	}
+	// children can't have cpus the parent doesn't have on cgroup v1, narrow them first
+	for i := len(cgroups) - 1; i >= 0; i-- {
+		cgroup := cgroups[i]
+		original, current, err := s.readCgroupCPUs(cgroup)
+		if err != nil || current.Intersection(banned).IsEmpty() {
+			continue
+		}
+		updated := current.Difference(banned)
+		if updated.IsEmpty() {
+			continue
+		}
+		if err := s.writeCgroupCPUs(cgroup, updated.CPUList()); err != nil {
+			status.Failed["cgroup/"+cgroup] = err
+			continue
+		}
+		if _, ok := s.Cgroups[cgroup]; !ok {
+			s.Cgroups[cgroup] = original
+		}
+		status.Cgroups = append(status.Cgroups, cgroup)
+	}
+	return status, s.persist()
+}
+
+// Unban adds given cpus back to the affinity of the kernel threads and cgroups which
+// had them originally. When it's the last unban, i.e. no banned cpu is left, all of
+// them get their original affinity back and the original affinities are forgotten.
+func (s *HousekeepingAffinityStore) Unban(cpus string, last bool) (*HousekeepingAffinityStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := &HousekeepingAffinityStatus{Failed: make(map[string]error)}
+	freed, err := ParseCPUList(cpus)
+	if err != nil {
+		return status, err
+	}
+	pids := make([]int, 0, len(s.Kthreads))
+	for pid := range s.Kthreads {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		saved := s.Kthreads[pid]
+		if comm, flags, err := readTaskStat(s.procDir, pid); err != nil || comm != saved.Comm || flags&pfKthread == 0 {
+			// kernel thread is gone, the pid may be reused meanwhile
+			delete(s.Kthreads, pid)
+			continue
+		}
+		current, err := schedGetaffinity(pid)
+		if err != nil {
+			continue
+		}
+		original, err := ParseCPUList(saved.Original)
+		if err != nil {
+			delete(s.Kthreads, pid)
+			continue
+		}
+		updated := current.Union(original.Intersection(freed))
+		if last {
+			updated = original
+		}
+		if !updated.Equals(current) {
+			if err := schedSetaffinity(pid, updated); err != nil {
+				status.Failed["kthread/"+strconv.Itoa(pid)] = err
+				continue
+			}
+			status.Kthreads = append(status.Kthreads, pid)
+		}
+		if last {
+			delete(s.Kthreads, pid)
+		}
+	}
+
+	cgroups, err := s.listCgroups()
+	if err != nil {
+		return status, err
+	}
+	// parents are widened before their children
+	for _, cgroup := range cgroups {
+		saved, ok := s.Cgroups[cgroup]
+		if !ok {
+			continue
+		}
+		raw, current, err := s.readCgroupCPUs(cgroup)
+		if err != nil {
+			continue
+		}
+		original, err := ParseCPUList(saved)
+		if err != nil {
+			delete(s.Cgroups, cgroup)
+			continue
+		}
+		if saved == "" {
+			// the cgroup inherited all the cpus of its parent
+			original = freed
+		}
+		updated := current.Union(original.Intersection(freed)).CPUList()
+		if last {
+			updated = saved
+		}
+		if updated == raw {
+			continue
+		}
+		if err := s.writeCgroupCPUs(cgroup, updated); err != nil {
+			status.Failed["cgroup/"+cgroup] = err
+			continue
+		}
+		status.Cgroups = append(status.Cgroups, cgroup)
+	}
+	if last {
+		s.Cgroups = make(map[string]string)
+	}
+	return status, s.persist()
+}
+
+// cpusetDir returns the cpuset hierarchy, of cgroup v1 cpuset controller or else the
+// unified cgroup v2 hierarchy
+func (s *HousekeepingAffinityStore) cpusetDir() string {
+	if _, err := os.Stat(filepath.Join(s.cgroupDir, "cpuset", cpusetCPUsFileName)); err == nil {
+		return filepath.Join(s.cgroupDir, "cpuset")
+	}
+	return s.cgroupDir
+}
+
+// listCgroups returns the host service cgroups and their descendants having cpuset,
+// every parent before its children
+func (s *HousekeepingAffinityStore) listCgroups() ([]string, error) {
+	dir := s.cpusetDir()
+	var cgroups []string
+	for _, service := range HostServiceCgroups {
+		err := filepath.Walk(filepath.Join(dir, service), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if _, err := os.Stat(filepath.Join(path, cpusetCPUsFileName)); err != nil {
+				// cpuset controller isn't enabled for the subtree
+				return filepath.SkipDir
+			}
+			cgroup, _ := filepath.Rel(dir, path)
+			cgroups = append(cgroups, cgroup)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cgroups, nil
+}
+
+// readCgroupCPUs returns cpuset.cpus of the cgroup as is, and the cpus it runs on
+func (s *HousekeepingAffinityStore) readCgroupCPUs(cgroup string) (string, CPUMask, error) {
+	dir := filepath.Join(s.cpusetDir(), cgroup)
+	content, err := ioutil.ReadFile(filepath.Join(dir, cpusetCPUsFileName))
+	if err != nil {
+		return "", NewCPUMask(), err
+	}
+	cpus := strings.TrimSpace(string(content))
+	effective := cpus
+	if cpus == "" {
+		// cgroup v2 cpuset inheriting the parent cpus
+		content, err := ioutil.ReadFile(filepath.Join(dir, cpusetEffectiveCPUsFileName))
+		if err != nil {
+			return "", NewCPUMask(), err
+		}
+		effective = strings.TrimSpace(string(content))
+	}
+	mask, err := ParseCPUList(effective)
+	if err != nil {
+		logrus.Warnf("invalid cpus %q of cgroup %s: %v", effective, cgroup, err)
+	}
+	return cpus, mask, err
+}
+
+func (s *HousekeepingAffinityStore) writeCgroupCPUs(cgroup, cpus string) error {
+	return ioutil.WriteFile(filepath.Join(s.cpusetDir(), cgroup, cpusetCPUsFileName), []byte(cpus), 0o644)
+}
+
+func (s *HousekeepingAffinityStore) persist() error {
+	return writeStateFile(s.file, s)
+}
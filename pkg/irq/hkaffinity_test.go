@@ -0,0 +1,188 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// createProcDir creates proc directory with stat and comm files for every task, given
+// by pid as comm and flags
+func createProcDir(g *WithT, tasks map[int]string) string {
+	dir, err := ioutil.TempDir("", "proc")
+	g.Expect(err).NotTo(HaveOccurred())
+	for pid, task := range tasks {
+		fields := strings.Fields(task)
+		stat := fmt.Sprintf("%d (%s) S 2 0 0 0 -1 %s 0 0 0 0\n", pid, fields[0], fields[1])
+		g.Expect(os.Mkdir(filepath.Join(dir, strconv.Itoa(pid)), 0755)).NotTo(HaveOccurred())
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(pid), "stat"), []byte(stat), 0644)).NotTo(HaveOccurred())
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(pid), "comm"), []byte(fields[0]+"\n"), 0644)).NotTo(HaveOccurred())
+	}
+	return dir
+}
+
+// fakeAffinity makes affinity of tasks read from and written into given map until
+// returned func is called
+func fakeAffinity(affinity map[int]CPUMask) func() {
+	get, set := schedGetaffinity, schedSetaffinity
+	schedGetaffinity = func(pid int) (CPUMask, error) { return affinity[pid], nil }
+	schedSetaffinity = func(pid int, cpus CPUMask) error {
+		affinity[pid] = cpus
+		return nil
+	}
+	return func() {
+		schedGetaffinity, schedSetaffinity = get, set
+	}
+}
+
+func TestListKthreads(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createProcDir(g, map[int]string{
+		1:  "systemd 4194560",
+		10: "kswapd0 2129984",
+		13: "kworker/u16:0-events_unbound 69238880",
+		11: "ksoftirqd/0 69238848",
+		12: "irq/30-eth0-TxRx-0 2129984",
+	})
+	defer os.RemoveAll(dir)
+
+	kthreads, err := ListKthreads(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kthreads).To(Equal([]Kthread{
+		{PID: 10, Comm: "kswapd0", Movable: true},
+		{PID: 11, Comm: "ksoftirqd/0", Movable: false},
+		{PID: 12, Comm: "irq/30-eth0-TxRx-0", Movable: true},
+		// unbound kworkers follow the workqueue cpumask
+		{PID: 13, Comm: "kworker/u16:0-events_unbound", Movable: false},
+	}))
+}
+
+func TestListIRQThreads(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createProcDir(g, map[int]string{
+		10: "irq/30-eth0-TxRx 2129984",
+		11: "irq/30-s-eth0-Tx 2129984",
+		12: "irq/9-acpi 2129984",
+		13: "kswapd0 2129984",
+		// user process named like an irq thread
+		14: "irq/31-fake 4194560",
+	})
+	defer os.RemoveAll(dir)
+
+	threads, err := ListIRQThreads(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(threads).To(Equal(map[int][]int{30: {10, 11}, 9: {12}}))
+}
+
+func TestHousekeepingAffinityStore(t *testing.T) {
+	g := NewGomegaWithT(t)
+	procDir := createProcDir(g, map[int]string{
+		10: "kcompactd0 2129984",
+		11: "ksoftirqd/1 69238848",
+		12: "irq/30-eth0 2129984",
+		13: "khugepaged 2129984",
+	})
+	defer os.RemoveAll(procDir)
+	affinity := map[int]CPUMask{
+		10: NewCPUMask(0, 1, 2, 3),
+		11: NewCPUMask(1),
+		12: NewCPUMask(1),
+		13: NewCPUMask(1, 2),
+	}
+	defer fakeAffinity(affinity)()
+	// cgroup v1 cpuset hierarchy
+	cgroupDir := createNetDir(g, map[string]string{
+		"cpuset/cpuset.cpus":                           "0-3",
+		"cpuset/system.slice/cpuset.cpus":              "0-3",
+		"cpuset/system.slice/sshd.service/cpuset.cpus": "0-3",
+		"cpuset/init.scope/cpuset.cpus":                "0-3",
+		"cpuset/kubepods/cpuset.cpus":                  "0-3",
+	})
+	defer os.RemoveAll(cgroupDir)
+	storeFile := filepath.Join(procDir, "housekeeping_affinity")
+	readCgroup := func(cgroup string) string {
+		return readQueueMask(g, cgroupDir, filepath.Join("cpuset", cgroup, "cpuset.cpus"))
+	}
+
+	store, err := NewHousekeepingAffinityStore(procDir, cgroupDir, storeFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	status, err := store.Ban("1-2")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Failed).To(BeEmpty())
+	// per-cpu kthread, irq thread and khugepaged without cpu left are left alone
+	g.Expect(status.Kthreads).To(Equal([]int{10}))
+	g.Expect(affinity[10].CPUList()).To(Equal("0,3"))
+	g.Expect(affinity[13].CPUList()).To(Equal("1-2"))
+	g.Expect(status.Cgroups).To(ConsistOf("system.slice", "system.slice/sshd.service", "init.scope"))
+	g.Expect(readCgroup("system.slice")).To(Equal("0,3"))
+	g.Expect(readCgroup("system.slice/sshd.service")).To(Equal("0,3"))
+	g.Expect(readCgroup("kubepods")).To(Equal("0-3"))
+
+	// original affinities survive restart and further bans keep them
+	store, err = NewHousekeepingAffinityStore(procDir, cgroupDir, storeFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.Ban("3")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Kthreads).To(Equal(map[int]KthreadAffinity{10: {Comm: "kcompactd0", Original: "0-3"}}))
+	g.Expect(store.Cgroups).To(HaveKeyWithValue("system.slice", "0-3"))
+
+	_, err = store.Unban("1-2", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(affinity[10].CPUList()).To(Equal("0-2"))
+	g.Expect(readCgroup("system.slice")).To(Equal("0-2"))
+	g.Expect(readCgroup("system.slice/sshd.service")).To(Equal("0-2"))
+
+	_, err = store.Unban("3", true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(affinity[10].CPUList()).To(Equal("0-3"))
+	g.Expect(readCgroup("system.slice")).To(Equal("0-3"))
+	g.Expect(readCgroup("init.scope")).To(Equal("0-3"))
+	g.Expect(store.Kthreads).To(BeEmpty())
+	g.Expect(store.Cgroups).To(BeEmpty())
+}
+
+func TestHousekeepingAffinityStoreCgroupV2(t *testing.T) {
+	g := NewGomegaWithT(t)
+	procDir := createProcDir(g, nil)
+	defer os.RemoveAll(procDir)
+	defer fakeAffinity(map[int]CPUMask{})()
+	cgroupDir := createNetDir(g, map[string]string{
+		"system.slice/cpuset.cpus":           "",
+		"system.slice/cpuset.cpus.effective": "0-3",
+	})
+	defer os.RemoveAll(cgroupDir)
+
+	store, err := NewHousekeepingAffinityStore(procDir, cgroupDir, filepath.Join(procDir, "housekeeping_affinity"))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.Ban("2")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(readQueueMask(g, cgroupDir, "system.slice/cpuset.cpus")).To(Equal("0-1,3"))
+	g.Expect(store.Cgroups).To(Equal(map[string]string{"system.slice": ""}))
+
+	// cgroup inheriting parent cpus is back to inheriting
+	_, err = store.Unban("2", true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(readQueueMask(g, cgroupDir, "system.slice/cpuset.cpus")).To(Equal(""))
+}
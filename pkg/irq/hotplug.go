@@ -0,0 +1,106 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultHotplugInterval interval between two polls of online cpus
+const DefaultHotplugInterval = 5 * time.Second
+
+// CPUHotplugEvent change of online cpus
+type CPUHotplugEvent struct {
+	// Online cpus online after the change
+	Online CPUMask
+	// Onlined cpus which came online
+	Onlined CPUMask
+	// Offlined cpus which went offline
+	Offlined CPUMask
+}
+
+// HotplugWatcher polls online cpus in sysfs cpu directory and hands every change
+// over to the handler
+type HotplugWatcher struct {
+	dir      string
+	interval time.Duration
+	handler  func(event CPUHotplugEvent)
+	online   CPUMask
+}
+
+// NewHotplugWatcher returns hotplug watcher starting from the currently online cpus
+func NewHotplugWatcher(dir string, interval time.Duration, handler func(event CPUHotplugEvent)) (*HotplugWatcher, error) {
+	topology, err := ReadCPUTopology(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &HotplugWatcher{
+		dir:      dir,
+		interval: interval,
+		handler:  handler,
+		online:   topology.Online,
+	}, nil
+}
+
+// Run polls online cpus in every interval until stop channel is closed, nothing is
+// polled if the interval isn't positive.
+func (w *HotplugWatcher) Run(stop <-chan struct{}) {
+	if w.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := w.Check(); err != nil {
+				logrus.Errorf("error checking online cpus: %v", err)
+			}
+		}
+	}
+}
+
+// Check polls online cpus once, calls the handler and returns true when they changed
+func (w *HotplugWatcher) Check() (bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(w.dir, "online"))
+	if err != nil {
+		return false, err
+	}
+	online, err := ParseCPUList(string(content))
+	if err != nil {
+		return false, err
+	}
+	if online.Equals(w.online) {
+		return false, nil
+	}
+	event := CPUHotplugEvent{
+		Online:   online,
+		Onlined:  online.Difference(w.online),
+		Offlined: w.online.Difference(online),
+	}
+	logrus.Infof("cpu hotplug: cpus %q went offline, cpus %q came online, online cpus are %s",
+		event.Offlined.CPUList(), event.Onlined.CPUList(), online.CPUList())
+	w.online = online
+	w.handler(event)
+	return true, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestHotplugWatcher(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createCPUTopologyDir(g, map[string]string{"possible": "0-7", "present": "0-7", "online": "0-7"})
+	defer os.RemoveAll(dir)
+
+	var events []CPUHotplugEvent
+	watcher, err := NewHotplugWatcher(dir, time.Minute, func(event CPUHotplugEvent) {
+		events = append(events, event)
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	changed, err := watcher.Check()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(changed).To(BeFalse())
+
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "online"), []byte("0-2,4-7\n"), 0644)).NotTo(HaveOccurred())
+	changed, err = watcher.Check()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(changed).To(BeTrue())
+
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "online"), []byte("0-3,5-7\n"), 0644)).NotTo(HaveOccurred())
+	changed, err = watcher.Check()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(changed).To(BeTrue())
+
+	g.Expect(events).To(HaveLen(2))
+	g.Expect(events[0].Offlined.CPUList()).To(Equal("3"))
+	g.Expect(events[0].Onlined.IsEmpty()).To(BeTrue())
+	g.Expect(events[1].Offlined.CPUList()).To(Equal("4"))
+	g.Expect(events[1].Onlined.CPUList()).To(Equal("3"))
+	g.Expect(events[1].Online.CPUList()).To(Equal("0-3,5-7"))
+}
+
+func TestHotplugWatcherRunWithoutInterval(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createCPUTopologyDir(g, map[string]string{"possible": "0-7", "present": "0-7", "online": "0-7"})
+	defer os.RemoveAll(dir)
+
+	watcher, err := NewHotplugWatcher(dir, 0, func(CPUHotplugEvent) {})
+	g.Expect(err).NotTo(HaveOccurred())
+	stopped := make(chan struct{})
+	go func() {
+		watcher.Run(make(chan struct{}))
+		close(stopped)
+	}()
+	g.Eventually(stopped).Should(BeClosed())
+}
+
+func TestRetargetOfflineIRQs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		30: "00000030",
+		31: "00000018",
+		32: "00000003",
+	})
+	defer os.RemoveAll(dir)
+
+	status, err := RetargetOfflineIRQs(NewCPUMask(0, 1, 2, 3), "00000003", dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.MovedIRQs()).To(Equal([]int{30}))
+	g.Expect(status.Moved[30]).To(Equal(IRQAffinityChange{Original: "00000030", Applied: "00000003"}))
+
+	mask, err := RetrieveIRQSmpAffinity(dir, 31)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000018"))
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+)
+
+// DefaultMinHousekeepingCPUs number of online cpus always left to handle interrupts
+const DefaultMinHousekeepingCPUs = 1
+
+// HousekeepingPolicy guards the cpus handling interrupts from being isolated
+type HousekeepingPolicy struct {
+	// Reserved cpus which are never isolated
+	Reserved CPUMask
+	// MinCPUs minimum number of online cpus never isolated
+	MinCPUs int
+	// SystemReserved cpus reserved for the system by kubelet, those are never assigned
+	// to a pod and irqs moved off the isolated cpus go to them
+	SystemReserved CPUMask
+}
+
+// Admit returns the requested cpus which can be isolated in addition to the already
+// isolated cpus. Reserved cpus are left out, and nothing is admitted when isolating
+// the rest would leave less than the minimum number of online housekeeping cpus or
+// when the requested cpus contain system reserved cpus.
+func (p HousekeepingPolicy) Admit(requested, isolated, online CPUMask) (CPUMask, error) {
+	if reserved := requested.Intersection(p.SystemReserved); !reserved.IsEmpty() {
+		return NewCPUMask(), fmt.Errorf("cpus %s are reserved for the system by kubelet", reserved.CPUList())
+	}
+	admitted := requested.Difference(p.Reserved)
+	housekeeping := online.Difference(isolated.Union(admitted))
+	if n := housekeeping.CPUSet().Size(); n < p.MinCPUs {
+		return NewCPUMask(), fmt.Errorf("isolating cpus %s leaves %d housekeeping cpus (%s), minimum is %d",
+			admitted.CPUList(), n, housekeeping.CPUList(), p.MinCPUs)
+	}
+	return admitted, nil
+}
+
+// IRQTarget returns the online system reserved cpus irqs moved off the isolated cpus
+// go to, an empty mask when there are none
+func (p HousekeepingPolicy) IRQTarget(online CPUMask) CPUMask {
+	return p.SystemReserved.Intersection(online)
+}
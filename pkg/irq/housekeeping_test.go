@@ -0,0 +1,65 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestHousekeepingPolicyAdmit(t *testing.T) {
+	g := NewGomegaWithT(t)
+	policy := HousekeepingPolicy{Reserved: NewCPUMask(0), MinCPUs: 2}
+	online := NewCPUMask(0, 1, 2, 3, 4, 5, 6, 7)
+
+	admitted, err := policy.Admit(NewCPUMask(2, 3), NewCPUMask(), online)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(admitted.CPUList()).To(Equal("2-3"))
+
+	// reserved cpu is left out
+	admitted, err = policy.Admit(NewCPUMask(0, 4), NewCPUMask(2, 3), online)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(admitted.CPUList()).To(Equal("4"))
+
+	// cpus 0 and 1 must stay housekeeping cpus
+	admitted, err = policy.Admit(NewCPUMask(1, 5), NewCPUMask(2, 3, 4, 6, 7), online)
+	g.Expect(err).To(MatchError("isolating cpus 1,5 leaves 1 housekeeping cpus (0), minimum is 2"))
+	g.Expect(admitted.IsEmpty()).To(BeTrue())
+
+	// cpus already isolated by another pod don't count twice
+	admitted, err = policy.Admit(NewCPUMask(2, 3), NewCPUMask(2, 3, 4, 5, 6, 7), online)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(admitted.CPUList()).To(Equal("2-3"))
+}
+
+func TestHousekeepingPolicySystemReserved(t *testing.T) {
+	g := NewGomegaWithT(t)
+	policy := HousekeepingPolicy{SystemReserved: NewCPUMask(0, 1), MinCPUs: 1}
+	online := NewCPUMask(1, 2, 3, 4, 5, 6, 7)
+
+	admitted, err := policy.Admit(NewCPUMask(1, 2), NewCPUMask(), online)
+	g.Expect(err).To(MatchError("cpus 1 are reserved for the system by kubelet"))
+	g.Expect(admitted.IsEmpty()).To(BeTrue())
+
+	admitted, err = policy.Admit(NewCPUMask(2, 3), NewCPUMask(), online)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(admitted.CPUList()).To(Equal("2-3"))
+
+	g.Expect(policy.IRQTarget(online).CPUList()).To(Equal("1"))
+	g.Expect(HousekeepingPolicy{}.IRQTarget(online).IsEmpty()).To(BeTrue())
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ProcInterruptsFile file containing per cpu interrupt counts
+const ProcInterruptsFile = "/host/proc/interrupts"
+
+// Interrupts per cpu interrupt counts read from interrupts file
+type Interrupts struct {
+	// CPUs online cpu of each count column
+	CPUs []int
+	// Lines interrupt lines keyed by irq number or by name such as LOC, in file order
+	Lines []InterruptLine
+}
+
+// InterruptLine counts of a single interrupt line
+type InterruptLine struct {
+	// Name irq number or architecture specific interrupt name such as LOC or RES
+	Name string
+	// Counts interrupt count per cpu, in the order of Interrupts CPUs
+	Counts []uint64
+	// Description interrupt controller, trigger and device names
+	Description string
+}
+
+// IRQ returns irq number of the line, false for architecture specific interrupts
+func (l InterruptLine) IRQ() (int, bool) {
+	irq, err := strconv.Atoi(l.Name)
+	return irq, err == nil
+}
+
+// Total returns the sum of the line counts over all cpus
+func (l InterruptLine) Total() uint64 {
+	var total uint64
+	for _, count := range l.Counts {
+		total += count
+	}
+	return total
+}
+
+// Devices returns the device names of the line, description following the interrupt
+// controller and the hardware irq with its trigger type (e.g. 524288-edge)
+func (l InterruptLine) Devices() string {
+	fields := strings.Fields(l.Description)
+	for i, field := range fields {
+		if strings.HasSuffix(field, "-edge") || strings.HasSuffix(field, "-level") {
+			return strings.Join(fields[i+1:], " ")
+		}
+	}
+	return l.Description
+}
+
+// ReadInterrupts reads per cpu interrupt counts from given interrupts file
+func ReadInterrupts(interruptsFile string) (*Interrupts, error) {
+	content, err := ioutil.ReadFile(interruptsFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseInterrupts(string(content))
+}
+
+func parseInterrupts(content string) (*Interrupts, error) {
+	rows := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	interrupts := &Interrupts{}
+	for _, column := range strings.Fields(rows[0]) {
+		cpu, err := strconv.Atoi(strings.TrimPrefix(column, "CPU"))
+		if err != nil || !strings.HasPrefix(column, "CPU") {
+			return nil, fmt.Errorf("invalid interrupts header column %q", column)
+		}
+		interrupts.CPUs = append(interrupts.CPUs, cpu)
+	}
+	for _, row := range rows[1:] {
+		fields := strings.Fields(row)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasSuffix(fields[0], ":") {
+			return nil, fmt.Errorf("invalid interrupts line %q", row)
+		}
+		line := InterruptLine{Name: strings.TrimSuffix(fields[0], ":")}
+		fields = fields[1:]
+		// lines such as ERR and MIS have a single count instead of one per cpu
+		for len(line.Counts) < len(interrupts.CPUs) && len(fields) > 0 {
+			count, err := strconv.ParseUint(fields[0], 10, 64)
+			if err != nil {
+				break
+			}
+			line.Counts = append(line.Counts, count)
+			fields = fields[1:]
+		}
+		line.Description = strings.Join(fields, " ")
+		interrupts.Lines = append(interrupts.Lines, line)
+	}
+	return interrupts, nil
+}
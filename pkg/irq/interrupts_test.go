@@ -0,0 +1,76 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+const testInterrupts = `           CPU0       CPU1       CPU3       
+  0:         44          0          0   IO-APIC   2-edge      timer
+ 28:        100        200          3 PCI-MSIX-0000:00:01.0   0-edge      virtio0-config
+NMI:          0          0          0   Non-maskable interrupts
+LOC:       1000       2000       3000   Local timer interrupts
+ERR:          0
+`
+
+func writeInterruptsFile(g *WithT, dir, content string) string {
+	interruptsFile := filepath.Join(dir, "interrupts")
+	g.Expect(ioutil.WriteFile(interruptsFile, []byte(content), 0644)).NotTo(HaveOccurred())
+	return interruptsFile
+}
+
+func TestReadInterrupts(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "interrupts")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	interrupts, err := ReadInterrupts(writeInterruptsFile(g, dir, testInterrupts))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(interrupts.CPUs).To(Equal([]int{0, 1, 3}))
+	g.Expect(interrupts.Lines).To(HaveLen(5))
+
+	line := interrupts.Lines[1]
+	g.Expect(line.Name).To(Equal("28"))
+	g.Expect(line.Counts).To(Equal([]uint64{100, 200, 3}))
+	g.Expect(line.Total()).To(Equal(uint64(303)))
+	g.Expect(line.Description).To(Equal("PCI-MSIX-0000:00:01.0 0-edge virtio0-config"))
+	g.Expect(line.Devices()).To(Equal("virtio0-config"))
+	irq, ok := line.IRQ()
+	g.Expect(ok).To(BeTrue())
+	g.Expect(irq).To(Equal(28))
+
+	line = interrupts.Lines[3]
+	g.Expect(line.Name).To(Equal("LOC"))
+	g.Expect(line.Counts).To(Equal([]uint64{1000, 2000, 3000}))
+	g.Expect(line.Devices()).To(Equal("Local timer interrupts"))
+	_, ok = line.IRQ()
+	g.Expect(ok).To(BeFalse())
+
+	line = interrupts.Lines[4]
+	g.Expect(line.Name).To(Equal("ERR"))
+	g.Expect(line.Counts).To(Equal([]uint64{0}))
+
+	_, err = parseInterrupts("IRQ CPU0\n")
+	g.Expect(err).To(HaveOccurred())
+}
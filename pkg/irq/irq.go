@@ -20,17 +20,12 @@
 package irq
 
 import (
-	"encoding/hex"
-	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
-	"unicode"
 
 	"github.com/sirupsen/logrus"
-	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
 )
 
 const (
@@ -38,8 +33,6 @@ const (
 	IrqSmpAffinityProcFile = "/host/proc/irq/default_smp_affinity"
 	// PodIrqBannedCPUsFile file containing irq balance banned cpus parameter
 	PodIrqBannedCPUsFile = "/host/etc/sysconfig/pod_irq_banned_cpus"
-	// IrqBalanceBannedCpus key for IRQBALANCE_BANNED_CPUS parameter
-	IrqBalanceBannedCpus = "IRQBALANCE_BANNED_CPUS"
 )
 
 var mu sync.Mutex
@@ -61,91 +54,96 @@ func SetIRQLoadBalancing(cpus string, enable bool, irqSmpAffinityFile, podIrqBan
 	if err := ioutil.WriteFile(irqSmpAffinityFile, []byte(newIRQSMPSetting), 0o644); err != nil {
 		return err
 	}
+	return writePodIrqBannedCPUs(podIrqBannedCPUsFile, newIRQBalanceSetting)
+}
 
-	logrus.Infof("irqbalance banned cpus %s", newIRQBalanceSetting)
+// ApplyIRQLoadBalancing takes the given excluded cpus, i.e. the cpus isolated for the
+// pods along with the static banned cpus, and the cpus isolated with isolcpus out of
+// default smp affinity, and bans the online cpus left out of it. The other cpus are
+// left as they are, since the administrator or another tool may own them. Files are
+// written only when their content changes.
+func ApplyIRQLoadBalancing(excludedCPUs string, irqSmpAffinityFile, podIrqBannedCPUsFile string) error {
+	mu.Lock()
+	defer mu.Unlock()
 
-	// write to pod cpu banned file at last so that fnotify write event triggered at right time.
-	podIrqBannedCPUsConfig, err := os.Create(podIrqBannedCPUsFile)
+	current, err := RetrieveCPUMask(irqSmpAffinityFile)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := podIrqBannedCPUsConfig.Close(); err != nil {
-			logrus.Warnf("error closing irq banned cpu %s file %v", podIrqBannedCPUsFile, err)
-		}
-	}()
-
-	_, err = podIrqBannedCPUsConfig.WriteString(newIRQBalanceSetting)
+	cpuMask, bannedCPUMask, err := desiredIRQMasks(excludedCPUs, current)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	if !masksEqual(current, cpuMask) {
+		logrus.Infof("default smp affinity %s is changed to %s", current, cpuMask)
+		if err := ioutil.WriteFile(irqSmpAffinityFile, []byte(cpuMask), 0o644); err != nil {
+			return err
+		}
+	}
+	return writePodIrqBannedCPUs(podIrqBannedCPUsFile, bannedCPUMask)
 }
 
-func updateIrqBalanceConfigFile(irqBalanceConfigFile, newIRQBalanceSetting string) error {
-	input, err := ioutil.ReadFile(irqBalanceConfigFile)
+// desiredIRQMasks returns the default smp affinity and the pod banned cpus masks with
+// the excluded cpus and the cpus isolated with isolcpus taken out of the current
+// default smp affinity.
+func desiredIRQMasks(excludedCPUs, current string) (cpuMask, bannedCPUMask string, err error) {
+	excludedmask, err := ParseCPUList(excludedCPUs)
 	if err != nil {
-		logrus.Infof("irqbalance config file %s doesn't exist", irqBalanceConfigFile)
-		return nil
+		return "", "", err
 	}
-	lines := strings.Split(string(input), "\n")
-	found := false
-	for i, line := range lines {
-		if strings.Contains(line, IrqBalanceBannedCpus+"=") {
-			lines[i] = IrqBalanceBannedCpus + "=" + "\"" + newIRQBalanceSetting + "\""
-			found = true
-		}
-	}
-	output := strings.Join(lines, "\n")
-	if !found {
-		output = output + "\n" + IrqBalanceBannedCpus + "=" + "\"" + newIRQBalanceSetting + "\"" + "\n"
+	currentmask, err := ParseCPUMask(current)
+	if err != nil {
+		return "", "", err
 	}
-	if err := ioutil.WriteFile(irqBalanceConfigFile, []byte(output), 0644); err != nil {
-		return err
+	topology, err := ReadCPUTopology(CPUTopologyDir)
+	if err != nil {
+		return "", "", err
 	}
-	return nil
+	housekeeping := currentmask.Difference(excludedmask).Difference(topology.Isolated)
+	width := topology.Width()
+	return housekeeping.Format(width), housekeeping.Complement(topology.Online).Format(width), nil
 }
 
-// ResetIRQBalance restart irqbalance daemon with newIRQBalanceSetting
-func ResetIRQBalance(irqBalanceConfigFile, newIRQBalanceSetting string) error {
-	logrus.Infof("restart irqbalance with banned cpus %s", newIRQBalanceSetting)
-	if err := updateIrqBalanceConfigFile(irqBalanceConfigFile, newIRQBalanceSetting); err != nil {
-		return err
+// writePodIrqBannedCPUs writes the banned cpus mask into pod irq banned cpus file,
+// unless it's there already, since every write makes irqsmpdaemon reset irqbalance.
+func writePodIrqBannedCPUs(podIrqBannedCPUsFile, newIRQBalanceSetting string) error {
+	if current, err := RetrieveCPUMask(podIrqBannedCPUsFile); err == nil && current == newIRQBalanceSetting {
+		return nil
 	}
-	cmd1 := exec.Command("service", "irqbalance", "restart")
-	if err := cmd1.Run(); err != nil {
-		logrus.Errorf("error restarting irqbalance service: error %v", err)
-		cmd2 := exec.Command("irqbalance", "--oneshot")
-		additionalEnv := IrqBalanceBannedCpus + "=" + newIRQBalanceSetting
-		cmd2.Env = append(os.Environ(), additionalEnv)
-		return cmd2.Run()
+	logrus.Infof("irqbalance banned cpus %s", newIRQBalanceSetting)
+
+	// write to pod cpu banned file at last so that fnotify write event triggered at right time.
+	// the file is truncated after writing rather than before, an empty file is never
+	// seen in between.
+	podIrqBannedCPUsConfig, err := os.OpenFile(podIrqBannedCPUsFile, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
 	}
-	logrus.Infof("irqbalance service is restarted")
+	defer func() {
+		if err := podIrqBannedCPUsConfig.Close(); err != nil {
+			logrus.Warnf("error closing irq banned cpu %s file %v", podIrqBannedCPUsFile, err)
+		}
+	}()
 
-	return nil
+	n, err := podIrqBannedCPUsConfig.WriteString(newIRQBalanceSetting)
+	if err != nil {
+		return err
+	}
+	return podIrqBannedCPUsConfig.Truncate(int64(n))
 }
 
-// InvertMaskStringWithComma invert the give mask string retaining the comma
+// InvertMaskStringWithComma returns the online cpus which are not in the given mask,
+// as wide as the kernel cpu masks
 func InvertMaskStringWithComma(maskStringWithComma string) (string, error) {
-	// only ascii string supported
-	if !isASCII(maskStringWithComma) {
-		return "", fmt.Errorf("non ascii character detected: %s", maskStringWithComma)
-	}
-
-	s := strings.ReplaceAll(maskStringWithComma, ",", "")
-	currentMaskArray, err := mapHexCharToByte(s)
+	mask, err := ParseCPUMask(maskStringWithComma)
 	if err != nil {
 		return "", err
 	}
-
-	invertedMaskString := mapByteToHexChar(invertByteArray(currentMaskArray))
-	invertedMaskStringWithComma := invertedMaskString[0:8]
-	for i := 8; i+8 <= len(invertedMaskString); i += 8 {
-		invertedMaskStringWithComma = invertedMaskStringWithComma + "," + invertedMaskString[i:i+8]
+	topology, err := ReadCPUTopology(CPUTopologyDir)
+	if err != nil {
+		return "", err
 	}
-
-	return invertedMaskStringWithComma, nil
+	return mask.Complement(topology.Online).Format(topology.Width()), nil
 }
 
 // RetrieveCPUMask retrieves cpu masks set in irq smp affinity file
@@ -157,118 +155,33 @@ func RetrieveCPUMask(irqSmpAffinityFile string) (string, error) {
 	return strings.TrimSpace(string(content)), nil
 }
 
-// The folloing methods are copied from github.com/cri-o/cri-o/internal/runtimehandlerhooks
-// (reuse not possible as runtimehandlerhooks in internal package)
-
 // UpdateIRQSmpAffinityMask take input cpus that need to change irq affinity mask and
-// the current mask string, return an update mask string and inverted mask, with those cpus
-// enabled or disable in the mask.
+// the current mask string, return an update mask string and the banned mask, i.e. the
+// online cpus not in the updated mask, with those cpus enabled or disable in the mask.
+// CPUs isolated with isolcpus are never enabled. Both masks are as wide as the kernel
+// cpu masks.
 func UpdateIRQSmpAffinityMask(cpus, current string, set bool) (cpuMask, bannedCPUMask string, err error) {
-	podcpuset, err := cpuset.Parse(cpus)
+	podmask, err := ParseCPUList(cpus)
 	if err != nil {
 		return cpus, "", err
 	}
-
-	// only ascii string supported
-	if !isASCII(current) {
-		return cpus, "", fmt.Errorf("non ascii character detected: %s", current)
-	}
-
-	// remove ","; now each element is "0-9,a-f"
-	s := strings.ReplaceAll(current, ",", "")
-
-	// the index 0 corresponds to the cpu 0-7
-	currentMaskArray, err := mapHexCharToByte(s)
+	currentmask, err := ParseCPUMask(current)
 	if err != nil {
 		return cpus, "", err
 	}
-	invertedMaskArray := invertByteArray(currentMaskArray)
-
-	for _, cpu := range podcpuset.ToSlice() {
-		if set {
-			// each byte represent 8 cpus
-			currentMaskArray[cpu/8] |= cpuMaskByte(cpu % 8)
-			invertedMaskArray[cpu/8] &^= cpuMaskByte(cpu % 8)
-		} else {
-			currentMaskArray[cpu/8] &^= cpuMaskByte(cpu % 8)
-			invertedMaskArray[cpu/8] |= cpuMaskByte(cpu % 8)
-		}
-	}
-
-	maskString := mapByteToHexChar(currentMaskArray)
-	invertedMaskString := mapByteToHexChar(invertedMaskArray)
-
-	maskStringWithComma := maskString[0:8]
-	invertedMaskStringWithComma := invertedMaskString[0:8]
-	for i := 8; i+8 <= len(maskString); i += 8 {
-		maskStringWithComma = maskStringWithComma + "," + maskString[i:i+8]
-		invertedMaskStringWithComma = invertedMaskStringWithComma + "," + invertedMaskString[i:i+8]
-	}
-	return maskStringWithComma, invertedMaskStringWithComma, nil
-}
-
-func isASCII(s string) bool {
-	for i := 0; i < len(s); i++ {
-		if s[i] > unicode.MaxASCII {
-			return false
-		}
-	}
-	return true
-}
-
-func cpuMaskByte(c int) byte {
-	return byte(1 << c)
-}
-
-func mapHexCharToByte(h string) ([]byte, error) {
-	l := len(h)
-	var hexin string
-	if l%2 != 0 {
-		// expect even number of chars
-		hexin = "0" + h
-	} else {
-		hexin = h
-	}
-
-	breversed, err := hex.DecodeString(hexin)
+	topology, err := ReadCPUTopology(CPUTopologyDir)
 	if err != nil {
-		return nil, err
-	}
-
-	l = len(breversed)
-	var barray []byte
-	var rindex int
-	for i := 0; i < l; i++ {
-		rindex = l - i - 1
-		barray = append(barray, breversed[rindex])
-	}
-	return barray, nil
-}
-
-func mapByteToHexChar(b []byte) string {
-	var breversed []byte
-	var rindex int
-	l := len(b)
-	// align it to 8 byte
-	if l%8 != 0 {
-		lfill := 8 - l%8
-		l += lfill
-		for i := 0; i < lfill; i++ {
-			b = append(b, byte(0))
-		}
-	}
-
-	for i := 0; i < l; i++ {
-		rindex = l - i - 1
-		breversed = append(breversed, b[rindex])
+		return cpus, "", err
 	}
-	return hex.EncodeToString(breversed)
-}
 
-// take a byte array and invert each byte
-func invertByteArray(in []byte) (out []byte) {
-	for _, b := range in {
-		out = append(out, byte(0xff)-b)
+	var updatedmask CPUMask
+	if set {
+		updatedmask = currentmask.Union(podmask)
+	} else {
+		updatedmask = currentmask.Difference(podmask)
 	}
-	return
+	// cpus isolated with isolcpus never take interrupts
+	updatedmask = updatedmask.Difference(topology.Isolated)
+	width := topology.Width()
+	return updatedmask.Format(width), updatedmask.Complement(topology.Online).Format(width), nil
 }
@@ -19,7 +19,9 @@ package irq
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
 )
@@ -31,6 +33,7 @@ const (
 
 func TestSetIRQLoadBalancing(t *testing.T) {
 	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-55", "0-55")()
 
 	fa, err := os.OpenFile(irqSmpAffinityProcFile, os.O_CREATE|os.O_WRONLY, 0644)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -70,11 +73,65 @@ func TestSetIRQLoadBalancing(t *testing.T) {
 	rawBytes, err = ioutil.ReadAll(fb)
 	g.Expect(fb.Close()).NotTo(HaveOccurred())
 	g.Expect(err).NotTo(HaveOccurred())
-	g.Expect(string(rawBytes)).To(Equal("ff000000,0000001f"))
+	g.Expect(string(rawBytes)).To(Equal("00000000,0000001f"))
+}
+
+func TestApplyIRQLoadBalancing(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-55", "0-55")()
+	dir, err := ioutil.TempDir("", "irq")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	smpAffinityFile := filepath.Join(dir, "default_smp_affinity")
+	bannedCPUsFile := filepath.Join(dir, "pod_irq_banned_cpus")
+	// cpus 0 and 3 are left out of default smp affinity by administrator, cpu 5 is
+	// isolated for a pod without being banned yet
+	g.Expect(ioutil.WriteFile(smpAffinityFile, []byte("00ffffff,fffffff6"), 0644)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(bannedCPUsFile, []byte("00000000,00000009"), 0644)).NotTo(HaveOccurred())
+
+	g.Expect(ApplyIRQLoadBalancing("1-2,5", smpAffinityFile, bannedCPUsFile)).To(Succeed())
+	content, err := ioutil.ReadFile(smpAffinityFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(content)).To(Equal("00ffffff,ffffffd0"))
+	content, err = ioutil.ReadFile(bannedCPUsFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(content)).To(Equal("00000000,0000002f"))
+
+	// nothing is written when the files already match
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	g.Expect(os.Chtimes(smpAffinityFile, past, past)).To(Succeed())
+	g.Expect(os.Chtimes(bannedCPUsFile, past, past)).To(Succeed())
+	g.Expect(ApplyIRQLoadBalancing("1-2,5", smpAffinityFile, bannedCPUsFile)).To(Succeed())
+	for _, file := range []string{smpAffinityFile, bannedCPUsFile} {
+		info, err := os.Stat(file)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(info.ModTime().Equal(past)).To(BeTrue())
+	}
+}
+
+func TestIRQLoadBalancingSkipsKernelIsolatedCPUs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	topologyDir := createCPUTopologyDir(g, map[string]string{
+		"possible": "0-7", "present": "0-7", "online": "0-7", "isolated": "6-7",
+	})
+	defer os.RemoveAll(topologyDir)
+	defer func(dir string) { CPUTopologyDir = dir }(CPUTopologyDir)
+	CPUTopologyDir = topologyDir
+
+	cpuMask, bannedCPUMask, err := UpdateIRQSmpAffinityMask("1-2,6", "ff", true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(cpuMask).To(Equal("0000003f"))
+	g.Expect(bannedCPUMask).To(Equal("000000c0"))
+
+	cpuMask, bannedCPUMask, err = desiredIRQMasks("1-2", "ff")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(cpuMask).To(Equal("00000039"))
+	g.Expect(bannedCPUMask).To(Equal("000000c6"))
 }
 
 func TestResetIRQLoadBalancing(t *testing.T) {
 	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-55", "0-55")()
 
 	fa, err := os.OpenFile(irqSmpAffinityProcFile, os.O_CREATE|os.O_WRONLY, 0644)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -120,5 +177,5 @@ func TestResetIRQLoadBalancing(t *testing.T) {
 	rawBytes, err = ioutil.ReadAll(fb)
 	g.Expect(fb.Close()).NotTo(HaveOccurred())
 	g.Expect(err).NotTo(HaveOccurred())
-	g.Expect(string(rawBytes)).To(Equal("ff000000,00000000"))
+	g.Expect(string(rawBytes)).To(Equal("00000000,00000000"))
 }
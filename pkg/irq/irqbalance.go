@@ -0,0 +1,305 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// IrqBalanceBannedCpus key for IRQBALANCE_BANNED_CPUS parameter
+	IrqBalanceBannedCpus = "IRQBALANCE_BANNED_CPUS"
+	// IrqBalanceBannedCpulist key for IRQBALANCE_BANNED_CPULIST parameter, which deprecates
+	// IRQBALANCE_BANNED_CPUS since irqbalance 1.8.0
+	IrqBalanceBannedCpulist = "IRQBALANCE_BANNED_CPULIST"
+	// IrqSmpStaticBannedCpus key for cpus banned by administrator (e.g. isolcpus or
+	// realtime cores), those are always kept in irqbalance banned cpus along with the
+	// pod banned cpus
+	IrqSmpStaticBannedCpus = "IRQSMP_STATIC_BANNED_CPUS"
+	// SysconfigIrqBalanceConfigFile irqbalance config file on rhel family hosts
+	SysconfigIrqBalanceConfigFile = "/etc/sysconfig/irqbalance"
+	// DefaultIrqBalanceConfigFile irqbalance config file on debian family hosts
+	DefaultIrqBalanceConfigFile = "/etc/default/irqbalance"
+	// HostIrqBalanceConfigFile irqbalance config file of rhel family hosts mounted into
+	// the daemonset pod
+	HostIrqBalanceConfigFile = "/host" + SysconfigIrqBalanceConfigFile
+)
+
+var (
+	irqBalanceVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)(\.(\d+))?`)
+	// irqBalanceVersionCommand prints installed irqbalance version
+	irqBalanceVersionCommand = []string{"irqbalance", "--version"}
+)
+
+// IRQBalanceConfig irqbalance config file along with the banned cpus key it understands
+type IRQBalanceConfig struct {
+	// File irqbalance config file path
+	File string
+	// UseCPUList writes banned cpus into IRQBALANCE_BANNED_CPULIST in cpulist syntax
+	// instead of IRQBALANCE_BANNED_CPUS in hex mask syntax
+	UseCPUList bool
+	// SocketDir directory of irqbalance control socket, banned cpus are pushed to the
+	// running irqbalance through the socket when found instead of restarting it
+	SocketDir string
+	// RestartPolicy methods tried in order to restart irqbalance when there is no socket
+	RestartPolicy []RestartMethod
+	// RestartTimeout time given to each restart method
+	RestartTimeout time.Duration
+}
+
+// BannedCPUsKey returns the key used for banned cpus
+func (c IRQBalanceConfig) BannedCPUsKey() string {
+	if c.UseCPUList {
+		return IrqBalanceBannedCpulist
+	}
+	return IrqBalanceBannedCpus
+}
+
+// DetectIRQBalanceConfig returns irqbalance config for the installed irqbalance. When
+// configFile is empty, the config file location is detected from the well known ones.
+// IRQBALANCE_BANNED_CPULIST is used for irqbalance 1.8.0 or newer, when the version
+// can't be detected, the key already present in the config file decides.
+func DetectIRQBalanceConfig(configFile string) IRQBalanceConfig {
+	if configFile == "" {
+		configFile = SysconfigIrqBalanceConfigFile
+		for _, file := range []string{SysconfigIrqBalanceConfigFile, DefaultIrqBalanceConfigFile} {
+			if _, err := os.Stat(file); err == nil {
+				configFile = file
+				break
+			}
+		}
+	}
+	config := IRQBalanceConfig{File: configFile, SocketDir: IrqBalanceSocketDir}
+	if version, err := exec.Command(irqBalanceVersionCommand[0], irqBalanceVersionCommand[1:]...).CombinedOutput(); err == nil {
+		if major, minor, ok := parseIRQBalanceVersion(string(version)); ok {
+			config.UseCPUList = major > 1 || (major == 1 && minor >= 8)
+			logrus.Infof("irqbalance version %d.%d detected, using %s in %s", major, minor,
+				config.BannedCPUsKey(), configFile)
+			return config
+		}
+	}
+	if _, found, err := retrieveIrqBalanceConfigValue(configFile, IrqBalanceBannedCpulist); err == nil && found {
+		config.UseCPUList = true
+	}
+	logrus.Infof("irqbalance version is unknown, using %s in %s", config.BannedCPUsKey(), configFile)
+	return config
+}
+
+func parseIRQBalanceVersion(version string) (major, minor int, ok bool) {
+	m := irqBalanceVersionRegexp.FindStringSubmatch(version)
+	if m == nil {
+		return 0, 0, false
+	}
+	major, _ = strconv.Atoi(m[1])
+	minor, _ = strconv.Atoi(m[2])
+	return major, minor, true
+}
+
+// bannedCPUsValue returns the banned cpus mask in the syntax of the key in use
+func (c IRQBalanceConfig) bannedCPUsValue(bannedCPUMask string) (string, error) {
+	if !c.UseCPUList {
+		return bannedCPUMask, nil
+	}
+	bannedmask, err := ParseCPUMask(bannedCPUMask)
+	if err != nil {
+		return "", err
+	}
+	return bannedmask.CPUList(), nil
+}
+
+func updateIrqBalanceConfigFile(config IRQBalanceConfig, newIRQBalanceSetting string) error {
+	value, err := config.bannedCPUsValue(newIRQBalanceSetting)
+	if err != nil {
+		return err
+	}
+	if err := updateIrqBalanceConfigValue(config.File, config.BannedCPUsKey(), value); err != nil {
+		return err
+	}
+	// drop the other key so that both can't disagree
+	staleKey := IrqBalanceBannedCpulist
+	if config.UseCPUList {
+		staleKey = IrqBalanceBannedCpus
+	}
+	return removeIrqBalanceConfigValue(config.File, staleKey)
+}
+
+func updateIrqBalanceConfigValue(irqBalanceConfigFile, key, value string) error {
+	input, err := ioutil.ReadFile(irqBalanceConfigFile)
+	if err != nil {
+		logrus.Infof("irqbalance config file %s doesn't exist", irqBalanceConfigFile)
+		return nil
+	}
+	lines := strings.Split(string(input), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), key+"=") {
+			lines[i] = key + "=" + "\"" + value + "\""
+			found = true
+		}
+	}
+	output := strings.Join(lines, "\n")
+	if !found {
+		output = output + "\n" + key + "=" + "\"" + value + "\"" + "\n"
+	}
+	if err := ioutil.WriteFile(irqBalanceConfigFile, []byte(output), 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func removeIrqBalanceConfigValue(irqBalanceConfigFile, key string) error {
+	input, err := ioutil.ReadFile(irqBalanceConfigFile)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(string(input), "\n")
+	output := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), key+"=") {
+			output = append(output, line)
+		}
+	}
+	if len(output) == len(lines) {
+		return nil
+	}
+	logrus.Infof("removing %s from irqbalance config file %s", key, irqBalanceConfigFile)
+	return ioutil.WriteFile(irqBalanceConfigFile, []byte(strings.Join(output, "\n")), 0644)
+}
+
+// RetrieveIRQBalanceBannedCPUs retrieves banned cpus mask set in irqbalance config file,
+// banned cpus set in cpulist syntax are converted into mask.
+func RetrieveIRQBalanceBannedCPUs(config IRQBalanceConfig) (string, error) {
+	value, _, err := retrieveIrqBalanceConfigValue(config.File, config.BannedCPUsKey())
+	if err != nil || !config.UseCPUList {
+		return value, err
+	}
+	bannedmask, err := ParseCPUList(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %s: %v", IrqBalanceBannedCpulist, value, err)
+	}
+	return bannedmask.String(), nil
+}
+
+func retrieveIrqBalanceConfigValue(irqBalanceConfigFile, key string) (value string, found bool, err error) {
+	input, err := ioutil.ReadFile(irqBalanceConfigFile)
+	if err != nil {
+		return "", false, err
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, key+"=") {
+			return strings.Trim(strings.TrimPrefix(line, key+"="), "\"'"), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// InitializeStaticBannedCPUs returns static banned cpus mask from irqbalance config file.
+// At first start the key is not there yet, so cpus banned in irqbalance config other
+// than the ones isolated for the pods, given in cpu list syntax, are recorded as static
+// banned cpus. The default smp affinity doesn't tell them apart, administrator may
+// narrow it along with the banned cpus (e.g. tuned cpu-partitioning).
+func InitializeStaticBannedCPUs(config IRQBalanceConfig, podIsolatedCPUs string) (string, error) {
+	staticBannedCPUs, found, err := retrieveIrqBalanceConfigValue(config.File, IrqSmpStaticBannedCpus)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil || found {
+		return staticBannedCPUs, err
+	}
+	bannedCPUs, err := RetrieveIRQBalanceBannedCPUs(config)
+	if err != nil {
+		return "", err
+	}
+	bannedmask, err := ParseCPUMask(bannedCPUs)
+	if err != nil {
+		return "", err
+	}
+	podmask, err := ParseCPUList(podIsolatedCPUs)
+	if err != nil {
+		return "", err
+	}
+	// banned cpus are empty when the key is missing or commented out
+	staticmask := bannedmask.Difference(podmask)
+	width := maskWidth(bannedCPUs)
+	if topology, err := ReadCPUTopology(CPUTopologyDir); err == nil && topology.Width() > width {
+		width = topology.Width()
+	}
+	staticBannedCPUs = staticmask.Format(width)
+	logrus.Infof("recording static banned cpus %s", staticBannedCPUs)
+	if err := updateIrqBalanceConfigValue(config.File, IrqSmpStaticBannedCpus, staticBannedCPUs); err != nil {
+		return "", err
+	}
+	return staticBannedCPUs, nil
+}
+
+// RetrieveStaticBannedCPUs returns static banned cpus recorded in irqbalance config
+// file, none when the file or the key isn't there yet
+func RetrieveStaticBannedCPUs(irqBalanceConfigFile string) (CPUMask, error) {
+	staticBannedCPUs, found, err := retrieveIrqBalanceConfigValue(irqBalanceConfigFile, IrqSmpStaticBannedCpus)
+	if os.IsNotExist(err) || (err == nil && !found) {
+		return NewCPUMask(), nil
+	} else if err != nil {
+		return NewCPUMask(), err
+	}
+	return ParseCPUMask(staticBannedCPUs)
+}
+
+// MergeBannedCPUs returns union of static and pod banned cpus masks, so that removing pod
+// banned cpus never unbans the cpus banned by administrator.
+func MergeBannedCPUs(staticBannedCPUs, podBannedCPUs string) (string, error) {
+	staticmask, err := ParseCPUMask(staticBannedCPUs)
+	if err != nil {
+		return "", err
+	}
+	podmask, err := ParseCPUMask(podBannedCPUs)
+	if err != nil {
+		return "", err
+	}
+	width := maskWidth(podBannedCPUs)
+	if maskWidth(staticBannedCPUs) > width {
+		width = maskWidth(staticBannedCPUs)
+	}
+	return staticmask.Union(podmask).Format(width), nil
+}
+
+// ResetIRQBalance applies newIRQBalanceSetting to the running irqbalance through its
+// control socket, restarts irqbalance daemon when there is no socket
+func ResetIRQBalance(config IRQBalanceConfig, newIRQBalanceSetting string) error {
+	logrus.Infof("reset irqbalance with banned cpus %s", newIRQBalanceSetting)
+	// config file is updated anyway so that banned cpus survive irqbalance restarts
+	if err := updateIrqBalanceConfigFile(config, newIRQBalanceSetting); err != nil {
+		return err
+	}
+	if config.SocketDir != "" {
+		err := NewIRQBalanceSocket(config.SocketDir).SetBannedCPUs(newIRQBalanceSetting)
+		if !errors.Is(err, ErrIRQBalanceSocketNotFound) {
+			return err
+		}
+		logrus.Infof("%v, restarting irqbalance", err)
+	}
+	return restartIRQBalance(config, newIRQBalanceSetting)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func createIRQBalanceConfigFile(g *WithT, content string) (dir, configFile string) {
+	dir, err := ioutil.TempDir("", "irqbalance")
+	g.Expect(err).NotTo(HaveOccurred())
+	configFile = filepath.Join(dir, "irqbalance")
+	g.Expect(ioutil.WriteFile(configFile, []byte(content), 0644)).NotTo(HaveOccurred())
+	return dir, configFile
+}
+
+func TestParseIRQBalanceVersion(t *testing.T) {
+	g := NewGomegaWithT(t)
+	major, minor, ok := parseIRQBalanceVersion("irqbalance version 1.8.0\n")
+	g.Expect(ok).To(BeTrue())
+	g.Expect([]int{major, minor}).To(Equal([]int{1, 8}))
+	major, minor, ok = parseIRQBalanceVersion("irqbalance version 1.4")
+	g.Expect(ok).To(BeTrue())
+	g.Expect([]int{major, minor}).To(Equal([]int{1, 4}))
+	_, _, ok = parseIRQBalanceVersion("irqbalance: unrecognized option")
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestUpdateIrqBalanceConfigFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, configFile := createIRQBalanceConfigFile(g, "#IRQBALANCE_BANNED_CPUS=\nIRQBALANCE_BANNED_CPUS=\"00000003\"\nIRQBALANCE_ARGS=\"\"\n")
+	defer os.RemoveAll(dir)
+
+	config := IRQBalanceConfig{File: configFile}
+	g.Expect(updateIrqBalanceConfigFile(config, "00000000,00000f00")).NotTo(HaveOccurred())
+	bannedCPUs, err := RetrieveIRQBalanceBannedCPUs(config)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bannedCPUs).To(Equal("00000000,00000f00"))
+
+	// newer irqbalance, the deprecated key is dropped
+	config.UseCPUList = true
+	g.Expect(updateIrqBalanceConfigFile(config, "00000000,00000f01")).NotTo(HaveOccurred())
+	content, err := ioutil.ReadFile(configFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(content)).To(Equal("#IRQBALANCE_BANNED_CPUS=\nIRQBALANCE_ARGS=\"\"\n\nIRQBALANCE_BANNED_CPULIST=\"0,8-11\"\n"))
+	bannedCPUs, err = RetrieveIRQBalanceBannedCPUs(config)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bannedCPUs).To(Equal("00000f01"))
+
+	// nothing banned yet
+	g.Expect(ioutil.WriteFile(configFile, []byte("IRQBALANCE_BANNED_CPULIST=\"\"\n"), 0644)).NotTo(HaveOccurred())
+	bannedCPUs, err = RetrieveIRQBalanceBannedCPUs(config)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bannedCPUs).To(Equal("00000000"))
+}
+
+func TestStaticBannedCPUs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-63", "0-63")()
+	dir, configFile := createIRQBalanceConfigFile(g, "IRQBALANCE_BANNED_CPUS=\"00000000,000000f1\"\n")
+	defer os.RemoveAll(dir)
+	config := IRQBalanceConfig{File: configFile}
+
+	// cpus 4-7 isolated for pods, cpu 0 banned by administrator
+	staticBannedCPUs, err := InitializeStaticBannedCPUs(config, "4-7")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(staticBannedCPUs).To(Equal("00000000,00000001"))
+
+	// static banned cpus are retained on next start
+	g.Expect(updateIrqBalanceConfigFile(config, "00000000,00000003")).NotTo(HaveOccurred())
+	staticBannedCPUs, err = InitializeStaticBannedCPUs(config, "1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(staticBannedCPUs).To(Equal("00000000,00000001"))
+
+	bannedCPUs, err := MergeBannedCPUs(staticBannedCPUs, "00000000,00000000")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bannedCPUs).To(Equal("00000000,00000001"))
+
+	bannedCPUs, err = MergeBannedCPUs(staticBannedCPUs, "00000001,00000300")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bannedCPUs).To(Equal("00000001,00000301"))
+
+	// stock config ships with the key commented out
+	g.Expect(ioutil.WriteFile(configFile, []byte("#IRQBALANCE_BANNED_CPUS=\n"), 0644)).NotTo(HaveOccurred())
+	staticBannedCPUs, err = InitializeStaticBannedCPUs(config, "4-7")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(staticBannedCPUs).To(Equal("00000000,00000000"))
+	bannedCPUs, err = MergeBannedCPUs("", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bannedCPUs).To(Equal("00000000"))
+
+	// no irqbalance config file
+	staticBannedCPUs, err = InitializeStaticBannedCPUs(IRQBalanceConfig{File: filepath.Join(dir, "missing")}, "1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(staticBannedCPUs).To(Equal(""))
+}
+
+func TestStaticBannedCPUsWithNarrowedDefaultSmpAffinity(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-7", "0-7")()
+	// tuned cpu-partitioning took cpus 2-3 out of default smp affinity and banned them,
+	// a pod owns cpu 5 on top of it
+	dir, configFile := createIRQBalanceConfigFile(g, "IRQBALANCE_BANNED_CPUS=\"0000002c\"\n")
+	defer os.RemoveAll(dir)
+	defaultSmpAffinity := "000000d3"
+	podBannedCPUs, err := InvertMaskStringWithComma(defaultSmpAffinity)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(podBannedCPUs).To(Equal("0000002c"))
+
+	// only the ledger cpus are pod bans, the narrowed cpus stay static
+	staticBannedCPUs, err := InitializeStaticBannedCPUs(IRQBalanceConfig{File: configFile}, "5")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(staticBannedCPUs).To(Equal("0000000c"))
+	staticmask, err := RetrieveStaticBannedCPUs(configFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(staticmask.CPUList()).To(Equal("2-3"))
+	staticmask, err = RetrieveStaticBannedCPUs(filepath.Join(dir, "missing"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(staticmask.IsEmpty()).To(BeTrue())
+
+	// pod goes away, cpus 2-3 stay banned
+	bannedCPUs, err := MergeBannedCPUs(staticBannedCPUs, "0000000c")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bannedCPUs).To(Equal("0000000c"))
+}
+
+func TestDetectIRQBalanceConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, configFile := createIRQBalanceConfigFile(g, "IRQBALANCE_BANNED_CPUS=\"00000006\"\n")
+	defer os.RemoveAll(dir)
+	defer func(command []string) { irqBalanceVersionCommand = command }(irqBalanceVersionCommand)
+
+	irqBalanceVersionCommand = []string{"echo", "irqbalance version 1.9.2"}
+	config := DetectIRQBalanceConfig(configFile)
+	g.Expect(config).To(Equal(IRQBalanceConfig{File: configFile, UseCPUList: true, SocketDir: IrqBalanceSocketDir}))
+
+	irqBalanceVersionCommand = []string{"echo", "irqbalance version 1.7.0"}
+	config = DetectIRQBalanceConfig(configFile)
+	g.Expect(config).To(Equal(IRQBalanceConfig{File: configFile, UseCPUList: false, SocketDir: IrqBalanceSocketDir}))
+
+	// version unknown, the key present in config file decides
+	irqBalanceVersionCommand = []string{filepath.Join(dir, "irqbalance"), "--version"}
+	config = DetectIRQBalanceConfig(configFile)
+	g.Expect(config.UseCPUList).To(BeFalse())
+	g.Expect(ioutil.WriteFile(configFile, []byte("IRQBALANCE_BANNED_CPULIST=\"1-2\"\n"), 0644)).NotTo(HaveOccurred())
+	config = DetectIRQBalanceConfig(configFile)
+	g.Expect(config.UseCPUList).To(BeTrue())
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// HostProcDir proc directory of the host, sched_setaffinity needs the host pid
+	// namespace too
+	HostProcDir = "/host/proc"
+
+	// pfKthread task flag of kernel threads
+	pfKthread = 0x00200000
+	// pfNoSetAffinity task flag of kernel threads bound to a cpu, e.g. per-cpu ones
+	pfNoSetAffinity = 0x04000000
+)
+
+// schedGetaffinity and schedSetaffinity access cpu affinity of a task, overridden in tests
+var (
+	schedGetaffinity = func(pid int) (CPUMask, error) {
+		set := unix.CPUSet{}
+		if err := unix.SchedGetaffinity(pid, &set); err != nil {
+			return NewCPUMask(), err
+		}
+		var cpus []int
+		for cpu := 0; cpu < len(set)*64; cpu++ {
+			if set.IsSet(cpu) {
+				cpus = append(cpus, cpu)
+			}
+		}
+		return NewCPUMask(cpus...), nil
+	}
+	schedSetaffinity = func(pid int, cpus CPUMask) error {
+		set := unix.CPUSet{}
+		for _, cpu := range cpus.CPUSet().ToSlice() {
+			set.Set(cpu)
+		}
+		return unix.SchedSetaffinity(pid, &set)
+	}
+)
+
+// IRQThreadProcDir proc directory the threaded irq handlers are looked up in, their
+// affinity follows smp affinity of their irq. Empty leaves their affinity alone.
+var IRQThreadProcDir = HostProcDir
+
+// Kthread kernel thread of the host
+type Kthread struct {
+	PID  int
+	Comm string
+	// Movable is false for kernel threads bound to a cpu
+	Movable bool
+}
+
+// ListKthreads returns kernel threads found in given proc directory, sorted by pid
+func ListKthreads(procDir string) ([]Kthread, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	var kthreads []Kthread
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		comm, flags, err := readTaskStat(procDir, pid)
+		if err != nil {
+			// task is gone meanwhile
+			continue
+		}
+		if flags&pfKthread == 0 {
+			continue
+		}
+		kthreads = append(kthreads, Kthread{PID: pid, Comm: comm, Movable: flags&pfNoSetAffinity == 0})
+	}
+	sort.Slice(kthreads, func(i, j int) bool { return kthreads[i].PID < kthreads[j].PID })
+	return kthreads, nil
+}
+
+// readTaskStat returns comm and flags of the task from its stat file
+func readTaskStat(procDir string, pid int) (string, uint64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", 0, err
+	}
+	stat := string(content)
+	// comm may contain spaces and parentheses, it's enclosed by the first ( and last )
+	start, end := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if start < 0 || end < start {
+		return "", 0, fmt.Errorf("invalid stat of task %d", pid)
+	}
+	// fields after comm: state ppid pgrp session tty_nr tpgid flags
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 7 {
+		return "", 0, fmt.Errorf("invalid stat of task %d", pid)
+	}
+	flags, err := strconv.ParseUint(fields[6], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid flags of task %d: %v", pid, err)
+	}
+	return stat[start+1 : end], flags, nil
+}
+
+// irqThreads pids of the threaded handlers of every irq
+type irqThreads map[int][]int
+
+// ListIRQThreads returns pids of the threaded handlers of every irq, i.e. the kernel
+// threads named irq/<N>-<name> in given proc directory
+func ListIRQThreads(procDir string) (map[int][]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	threads := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "comm"))
+		if err != nil || !strings.HasPrefix(string(content), irqThreadPrefix) {
+			continue
+		}
+		// irq number is followed by the handler name, or -s- on secondary handlers
+		fields := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(string(content)), irqThreadPrefix), "-", 2)
+		irq, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		// user processes can name themselves alike
+		if _, flags, err := readTaskStat(procDir, pid); err != nil || flags&pfKthread == 0 {
+			continue
+		}
+		threads[irq] = append(threads[irq], pid)
+	}
+	for irq := range threads {
+		sort.Ints(threads[irq])
+	}
+	return threads, nil
+}
+
+// listIRQThreads returns the threaded irq handlers found in IRQThreadProcDir, none
+// when the irqs are not threaded or the proc directory isn't there
+func listIRQThreads() irqThreads {
+	if IRQThreadProcDir == "" {
+		return nil
+	}
+	threads, err := ListIRQThreads(IRQThreadProcDir)
+	if err != nil {
+		logrus.Debugf("error listing threaded irq handlers: %v", err)
+		return nil
+	}
+	return threads
+}
+
+// follow sets affinity of the threaded handlers of the irq to its new smp affinity
+// mask, threads which couldn't be moved are reported in the status
+func (t irqThreads) follow(irq int, mask string, status *IRQAffinityStatus) {
+	pids := t[irq]
+	if len(pids) == 0 {
+		return
+	}
+	cpus, err := ParseCPUMask(mask)
+	if err != nil {
+		return
+	}
+	for _, pid := range pids {
+		if err := schedSetaffinity(pid, cpus); err != nil {
+			status.FailedThreads[pid] = fmt.Errorf("handler thread of irq %d: %v", irq, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"sigs.k8s.io/yaml"
+)
+
+// KubeletConfigFile kubelet config file of the host
+const KubeletConfigFile = kubeletRootDir + "config.yaml"
+
+// kubeletConfig the part of kubelet configuration irq-smp-balance cares about
+type kubeletConfig struct {
+	ReservedSystemCPUs string `json:"reservedSystemCPUs"`
+}
+
+// ReadKubeletReservedCPUsFromFile returns reservedSystemCPUs of the kubelet config file,
+// an empty mask when the file doesn't set it
+func ReadKubeletReservedCPUsFromFile(file string) (CPUMask, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return NewCPUMask(), err
+	}
+	config := kubeletConfig{}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return NewCPUMask(), fmt.Errorf("invalid kubelet config file %s: %v", file, err)
+	}
+	return parseKubeletReservedCPUs(config.ReservedSystemCPUs)
+}
+
+// ReadKubeletReservedCPUsFromConfigz returns reservedSystemCPUs of the running kubelet
+// served on its /configz endpoint, which also covers the --reserved-cpus flag
+func ReadKubeletReservedCPUsFromConfigz(client *http.Client, url string) (CPUMask, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return NewCPUMask(), err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NewCPUMask(), fmt.Errorf("kubelet configz %s returned %s", url, resp.Status)
+	}
+	configz := struct {
+		KubeletConfig kubeletConfig `json:"kubeletconfig"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&configz); err != nil {
+		return NewCPUMask(), fmt.Errorf("invalid kubelet configz %s: %v", url, err)
+	}
+	return parseKubeletReservedCPUs(configz.KubeletConfig.ReservedSystemCPUs)
+}
+
+func parseKubeletReservedCPUs(cpus string) (CPUMask, error) {
+	mask, err := ParseCPUList(cpus)
+	if err != nil {
+		return NewCPUMask(), fmt.Errorf("invalid kubelet reserved system cpus %q: %v", cpus, err)
+	}
+	return mask, nil
+}
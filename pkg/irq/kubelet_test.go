@@ -0,0 +1,83 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestReadKubeletReservedCPUsFromFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "kubelet")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+
+	g.Expect(ioutil.WriteFile(file, []byte(`apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+cpuManagerPolicy: static
+reservedSystemCPUs: 0-1,8
+`), 0644)).NotTo(HaveOccurred())
+	reserved, err := ReadKubeletReservedCPUsFromFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reserved.CPUList()).To(Equal("0-1,8"))
+
+	g.Expect(ioutil.WriteFile(file, []byte("cpuManagerPolicy: static\n"), 0644)).NotTo(HaveOccurred())
+	reserved, err = ReadKubeletReservedCPUsFromFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reserved.IsEmpty()).To(BeTrue())
+
+	g.Expect(ioutil.WriteFile(file, []byte("reservedSystemCPUs: x\n"), 0644)).NotTo(HaveOccurred())
+	_, err = ReadKubeletReservedCPUsFromFile(file)
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = ReadKubeletReservedCPUsFromFile(filepath.Join(dir, "missing.yaml"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+}
+
+func TestReadKubeletReservedCPUsFromConfigz(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configz := `{"kubeletconfig":{"cpuManagerPolicy":"static","reservedSystemCPUs":"0,4"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/configz" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, configz)
+	}))
+	defer server.Close()
+
+	reserved, err := ReadKubeletReservedCPUsFromConfigz(server.Client(), server.URL+"/configz")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reserved.CPUList()).To(Equal("0,4"))
+
+	configz = `{"kubeletconfig":{"cpuManagerPolicy":"static"}}`
+	reserved, err = ReadKubeletReservedCPUsFromConfigz(server.Client(), server.URL+"/configz")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reserved.IsEmpty()).To(BeTrue())
+
+	_, err = ReadKubeletReservedCPUsFromConfigz(server.Client(), server.URL+"/other")
+	g.Expect(err).To(MatchError(ContainSubstring("404 Not Found")))
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLeakageInterval interval between two interrupt samples on isolated cpus
+	DefaultLeakageInterval = 10 * time.Second
+	// DefaultLeakageThreshold interrupts per second above which a source on an isolated
+	// cpu is flagged, local timer ticks at HZ on cpus without nohz_full
+	DefaultLeakageThreshold = 1000
+)
+
+// InterruptRate rate of an interrupt source on a cpu
+type InterruptRate struct {
+	CPU int
+	// Source irq number or per-cpu interrupt name such as LOC, RES, CAL or TLB
+	Source string
+	// Devices device names of the irq, or description of the per-cpu interrupt
+	Devices string
+	// Rate interrupts per second
+	Rate float64
+	// Owners pods owning the cpu
+	Owners []string
+}
+
+// LeakageSample interrupt rates on isolated cpus between two samples
+type LeakageSample struct {
+	// CPURates total interrupt rate of each isolated cpu
+	CPURates map[int]float64
+	// Rates rate of every interrupt source having fired on isolated cpus, in interrupts
+	// file order
+	Rates []InterruptRate
+	// Flagged rates above the threshold
+	Flagged []InterruptRate
+}
+
+// LeakageMonitor samples interrupts file periodically, computes interrupt rates on
+// the cpus owned by pods and flags the sources above a threshold with their owners.
+type LeakageMonitor struct {
+	interruptsFile string
+	interval       time.Duration
+	threshold      float64
+	// owners returns owners of every isolated cpu
+	owners func() map[int][]string
+
+	mu           sync.Mutex
+	previous     *Interrupts
+	previousTime time.Time
+	last         *LeakageSample
+}
+
+// NewLeakageMonitor returns monitor sampling interruptsFile in every interval, flagging
+// interrupt sources above threshold per second on the cpus returned by owners
+func NewLeakageMonitor(interruptsFile string, interval time.Duration, threshold float64,
+	owners func() map[int][]string) *LeakageMonitor {
+	return &LeakageMonitor{
+		interruptsFile: interruptsFile,
+		interval:       interval,
+		threshold:      threshold,
+		owners:         owners,
+	}
+}
+
+// Run samples interrupts in every interval until stop channel is closed
+func (m *LeakageMonitor) Run(stop <-chan struct{}) {
+	if m.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sample, err := m.Sample(time.Now())
+			if err != nil {
+				logrus.Errorf("error sampling interrupts: %v", err)
+				continue
+			}
+			for _, rate := range sample.Flagged {
+				logrus.Warnf("interrupt leakage: %s (%s) fires %.1f/s on isolated cpu %d of %s",
+					rate.Source, rate.Devices, rate.Rate, rate.CPU, strings.Join(rate.Owners, ","))
+			}
+		}
+	}
+}
+
+// Sample reads interrupts taken at given time and returns the rates on isolated cpus
+// since the previous sample, an empty sample on the first one.
+func (m *LeakageMonitor) Sample(now time.Time) (*LeakageSample, error) {
+	interrupts, err := ReadInterrupts(m.interruptsFile)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, elapsed := m.previous, now.Sub(m.previousTime).Seconds()
+	m.previous, m.previousTime = interrupts, now
+	if previous == nil || elapsed <= 0 {
+		return &LeakageSample{CPURates: map[int]float64{}}, nil
+	}
+	owners := m.owners()
+	previousLines := make(map[string]InterruptLine, len(previous.Lines))
+	for _, line := range previous.Lines {
+		previousLines[line.Name] = line
+	}
+	sample := &LeakageSample{CPURates: make(map[int]float64)}
+	for column, cpu := range interrupts.CPUs {
+		if _, ok := owners[cpu]; !ok {
+			continue
+		}
+		previousColumn := indexOf(previous.CPUs, cpu)
+		if previousColumn < 0 {
+			// cpu came online meanwhile
+			continue
+		}
+		sample.CPURates[cpu] = 0
+		for _, line := range interrupts.Lines {
+			previousLine, ok := previousLines[line.Name]
+			if !ok || column >= len(line.Counts) || previousColumn >= len(previousLine.Counts) ||
+				line.Counts[column] <= previousLine.Counts[previousColumn] {
+				continue
+			}
+			rate := InterruptRate{
+				CPU:     cpu,
+				Source:  line.Name,
+				Devices: line.Devices(),
+				Rate:    float64(line.Counts[column]-previousLine.Counts[previousColumn]) / elapsed,
+				Owners:  owners[cpu],
+			}
+			sample.CPURates[cpu] += rate.Rate
+			sample.Rates = append(sample.Rates, rate)
+			if rate.Rate > m.threshold {
+				sample.Flagged = append(sample.Flagged, rate)
+			}
+		}
+	}
+	m.last = sample
+	// cpus no longer isolated are gone from the rates
+	metrics.InterruptRate.Reset()
+	for cpu, rate := range sample.CPURates {
+		metrics.InterruptRate.WithLabelValues(strconv.Itoa(cpu)).Set(rate)
+	}
+	return sample, nil
+}
+
+// LastSample returns the rates of the last sample, nil before the second sample
+func (m *LeakageMonitor) LastSample() *LeakageSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+func indexOf(values []int, value int) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLeakageMonitor(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "interrupts")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	interruptsFile := writeInterruptsFile(g, dir, `           CPU0       CPU1       CPU2
+ 28:        100          0          0   IR-PCI-MSI 1572864-edge      eth0-TxRx-0
+ 29:          0         50          0   IR-PCI-MSI 1572865-edge      eth0-TxRx-1
+LOC:       1000       2000       3000   Local timer interrupts
+RES:          5          5          5   Rescheduling interrupts
+`)
+	owners := map[int][]string{1: {"default/pod-1/app"}, 2: {"default/pod-2/app"}}
+	monitor := NewLeakageMonitor(interruptsFile, time.Second, 100, func() map[int][]string { return owners })
+
+	now := time.Now()
+	sample, err := monitor.Sample(now)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(sample.Rates).To(BeEmpty())
+	g.Expect(monitor.LastSample()).To(BeNil())
+
+	writeInterruptsFile(g, dir, `           CPU0       CPU1       CPU2
+ 28:       2100          0          0   IR-PCI-MSI 1572864-edge      eth0-TxRx-0
+ 29:          0       2050          0   IR-PCI-MSI 1572865-edge      eth0-TxRx-1
+LOC:       3000       2020       3040   Local timer interrupts
+RES:          5          5        305   Rescheduling interrupts
+`)
+	sample, err = monitor.Sample(now.Add(10 * time.Second))
+	g.Expect(err).NotTo(HaveOccurred())
+	// cpu 0 isn't isolated, idle sources aren't reported
+	g.Expect(sample.CPURates).To(Equal(map[int]float64{1: 202, 2: 34}))
+	g.Expect(sample.Rates).To(Equal([]InterruptRate{
+		{CPU: 1, Source: "29", Devices: "eth0-TxRx-1", Rate: 200, Owners: owners[1]},
+		{CPU: 1, Source: "LOC", Devices: "Local timer interrupts", Rate: 2, Owners: owners[1]},
+		{CPU: 2, Source: "LOC", Devices: "Local timer interrupts", Rate: 4, Owners: owners[2]},
+		{CPU: 2, Source: "RES", Devices: "Rescheduling interrupts", Rate: 30, Owners: owners[2]},
+	}))
+	g.Expect(sample.Flagged).To(Equal([]InterruptRate{
+		{CPU: 1, Source: "29", Devices: "eth0-TxRx-1", Rate: 200, Owners: owners[1]},
+	}))
+	g.Expect(monitor.LastSample()).To(Equal(sample))
+	g.Expect(testutil.ToFloat64(metrics.InterruptRate.WithLabelValues("1"))).To(Equal(float64(202)))
+	g.Expect(testutil.CollectAndCount(metrics.InterruptRate)).To(Equal(2))
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SysKernelDebugIRQDir debugfs directory containing per irq kernel state
+	SysKernelDebugIRQDir = "/host/sys/kernel/debug/irq/irqs"
+	// IRQLeakReportFile file containing the last irq leak report
+	IRQLeakReportFile = IrqSmpBalanceStateDir + "/irq_leaks"
+
+	// irqEffectiveAffinityFileName per irq file containing the cpus the irq is
+	// actually delivered to
+	irqEffectiveAffinityFileName = "effective_affinity"
+	// irqdAffinityManaged debugfs irq state of kernel managed irqs
+	irqdAffinityManaged = "IRQD_AFFINITY_MANAGED"
+)
+
+// IRQClass tells whether smp affinity of an irq can be changed
+type IRQClass string
+
+const (
+	// IRQMovable irq taking any smp affinity
+	IRQMovable IRQClass = "movable"
+	// IRQManaged irq whose affinity is managed by kernel, e.g. blk-mq queue irqs of
+	// nvme and virtio devices, it rejects smp affinity changes
+	IRQManaged IRQClass = "managed"
+	// IRQUnknown irq which can't be told apart without debugfs until its smp affinity
+	// is changed, e.g. after a restart
+	IRQUnknown IRQClass = "unknown"
+)
+
+// IRQLeak irq still delivered to isolated cpus
+type IRQLeak struct {
+	IRQ   int      `json:"irq"`
+	Class IRQClass `json:"class"`
+	// EffectiveCPUs cpus the irq is delivered to
+	EffectiveCPUs string `json:"effectiveCPUs"`
+	// Devices device names of the irq from the interrupts file
+	Devices string `json:"devices"`
+}
+
+// IRQLeakReport irqs hitting isolated cpus, along with all the managed irqs
+type IRQLeakReport struct {
+	IsolatedCPUs string `json:"isolatedCPUs"`
+	// Managed sorted numbers of all the managed irqs
+	Managed []int `json:"managed"`
+	// Unknown sorted numbers of the irqs whose class is unknown
+	Unknown []int `json:"unknown"`
+	// Leaks irqs delivered to isolated cpus, sorted by irq number
+	Leaks []IRQLeak `json:"leaks"`
+}
+
+// managedIRQs smp affinity files of the irqs written since start, true when the last
+// smp affinity change was rejected by kernel with EIO
+var managedIRQs = struct {
+	sync.Mutex
+	files map[string]bool
+}{files: make(map[string]bool)}
+
+// recordIRQSmpAffinityWrite remembers the irq as managed when writing its smp
+// affinity file failed with EIO, and as movable when the write succeeded.
+func recordIRQSmpAffinityWrite(file string, err error) {
+	managedIRQs.Lock()
+	defer managedIRQs.Unlock()
+	if err == nil {
+		managedIRQs.files[file] = false
+	} else if errors.Is(err, syscall.EIO) {
+		managedIRQs.files[file] = true
+	}
+}
+
+// ClassifyIRQ tells whether the irq is movable or managed. It's read from the irq
+// state in debugfs when available, otherwise from whether kernel rejected the last
+// smp affinity change of it with EIO, and the irq is unknown when it's not changed
+// since start. The irq isn't written to, so that classifying doesn't change the irq
+// routing.
+func ClassifyIRQ(irqProcDir, debugIRQDir string, irq int) (IRQClass, error) {
+	if content, err := ioutil.ReadFile(filepath.Join(debugIRQDir, strconv.Itoa(irq))); err == nil {
+		if strings.Contains(string(content), irqdAffinityManaged) {
+			return IRQManaged, nil
+		}
+		return IRQMovable, nil
+	}
+	file := irqSmpAffinityFile(irqProcDir, irq)
+	if _, err := os.Stat(file); err != nil {
+		return "", err
+	}
+	managedIRQs.Lock()
+	defer managedIRQs.Unlock()
+	managed, ok := managedIRQs.files[file]
+	if !ok {
+		return IRQUnknown, nil
+	} else if managed {
+		return IRQManaged, nil
+	}
+	return IRQMovable, nil
+}
+
+// RetrieveIRQEffectiveAffinity retrieves cpus the irq is actually delivered to, which
+// is smp affinity mask on kernels without effective affinity
+func RetrieveIRQEffectiveAffinity(irqProcDir string, irq int) (CPUMask, error) {
+	mask, err := RetrieveCPUMask(filepath.Join(irqProcDir, strconv.Itoa(irq), irqEffectiveAffinityFileName))
+	if err != nil {
+		if mask, err = RetrieveIRQSmpAffinity(irqProcDir, irq); err != nil {
+			return NewCPUMask(), err
+		}
+	}
+	return ParseCPUMask(mask)
+}
+
+// CheckIRQLeaks classifies every irq and reports the ones whose effective affinity
+// still has isolated cpus. IRQs given as exempt, e.g. device irqs pinned to pod
+// cpus on purpose, are not reported as leaks.
+func CheckIRQLeaks(isolated CPUMask, exempt []int, irqProcDir, debugIRQDir, interruptsFile string) (*IRQLeakReport, error) {
+	report := &IRQLeakReport{IsolatedCPUs: isolated.CPUList(), Managed: []int{}, Unknown: []int{}, Leaks: []IRQLeak{}}
+	irqs, err := ListIRQs(irqProcDir)
+	if err != nil {
+		return report, err
+	}
+	devices := make(map[int]string)
+	if interrupts, err := ReadInterrupts(interruptsFile); err != nil {
+		logrus.Debugf("error reading irq device names: %v", err)
+	} else {
+		for _, line := range interrupts.Lines {
+			if irq, ok := line.IRQ(); ok {
+				devices[irq] = line.Devices()
+			}
+		}
+	}
+	exempted := make(map[int]bool)
+	for _, irq := range exempt {
+		exempted[irq] = true
+	}
+	for _, irq := range irqs {
+		class, err := ClassifyIRQ(irqProcDir, debugIRQDir, irq)
+		if err != nil {
+			// irq without smp_affinity (e.g. irq 0) or gone meanwhile
+			continue
+		}
+		if class == IRQManaged {
+			report.Managed = append(report.Managed, irq)
+		} else if class == IRQUnknown {
+			report.Unknown = append(report.Unknown, irq)
+		}
+		if exempted[irq] || isolated.IsEmpty() {
+			continue
+		}
+		effective, err := RetrieveIRQEffectiveAffinity(irqProcDir, irq)
+		if err != nil || effective.Intersection(isolated).IsEmpty() {
+			continue
+		}
+		report.Leaks = append(report.Leaks, IRQLeak{
+			IRQ:           irq,
+			Class:         class,
+			EffectiveCPUs: effective.CPUList(),
+			Devices:       devices[irq],
+		})
+	}
+	return report, nil
+}
+
+// ReadIRQLeakReport reads the irq leak report from given file, an empty report when
+// there is none yet
+func ReadIRQLeakReport(file string) (*IRQLeakReport, error) {
+	report := &IRQLeakReport{}
+	if err := readStateFile(file, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// WriteIRQLeakReport writes the irq leak report into given file
+func WriteIRQLeakReport(file string, report *IRQLeakReport) error {
+	return writeStateFile(file, report)
+}
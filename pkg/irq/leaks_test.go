@@ -0,0 +1,110 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+const testLeakInterrupts = `           CPU0       CPU1       CPU2       CPU3
+ 24:         10          0          0          0   IR-PCI-MSI 524288-edge      nvme0q1
+ 25:          0         20          0          0   IR-PCI-MSI 524289-edge      nvme0q2
+ 26:          0          0         30          0   IR-PCI-MSI 1572864-edge      eth0-TxRx-0
+ 27:          0          0          0         40   IR-PCI-MSI 1572865-edge      eth0-TxRx-1
+ 28:          0          0          0         50   IR-PCI-MSI 524290-edge      nvme0q3
+`
+
+func TestCheckIRQLeaks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		24: "00000001",
+		25: "00000006",
+		26: "0000000d",
+		27: "00000008",
+		28: "00000008",
+	})
+	defer os.RemoveAll(dir)
+	// kernel may deliver the irq to a single cpu of its smp affinity, irq 27 is on a
+	// kernel without effective affinity
+	for irq, mask := range map[int]string{24: "00000001", 25: "00000002", 26: "00000004"} {
+		file := filepath.Join(dir, strconv.Itoa(irq), irqEffectiveAffinityFileName)
+		g.Expect(ioutil.WriteFile(file, []byte(mask+"\n"), 0644)).NotTo(HaveOccurred())
+	}
+	debugDir := createNetDir(g, map[string]string{
+		"24": "handler:  handle_edge_irq\ndstate:   0x3060a200\n            IRQD_AFFINITY_MANAGED\n",
+		"25": "handler:  handle_edge_irq\ndstate:   0x3060a200\n            IRQD_AFFINITY_MANAGED\n",
+		"26": "handler:  handle_edge_irq\ndstate:   0x10402200\n",
+	})
+	defer os.RemoveAll(debugDir)
+	interruptsFile := writeInterruptsFile(g, debugDir, testLeakInterrupts)
+	// kernel rejected moving irq 28, which has no debugfs state either, irq 27 isn't
+	// moved since start
+	recordIRQSmpAffinityWrite(irqSmpAffinityFile(dir, 28), &os.PathError{Op: "write", Err: syscall.EIO})
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, irq := range []int{27, 28} {
+		g.Expect(os.Chtimes(irqSmpAffinityFile(dir, irq), past, past)).To(Succeed())
+	}
+
+	report, err := CheckIRQLeaks(NewCPUMask(1, 2, 3), []int{27}, dir, debugDir, interruptsFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.IsolatedCPUs).To(Equal("1-3"))
+	g.Expect(report.Managed).To(Equal([]int{24, 25, 28}))
+	g.Expect(report.Unknown).To(Equal([]int{27}))
+	// irq 24 is delivered to a housekeeping cpu only and irq 27 is exempt
+	g.Expect(report.Leaks).To(Equal([]IRQLeak{
+		{IRQ: 25, Class: IRQManaged, EffectiveCPUs: "1", Devices: "nvme0q2"},
+		{IRQ: 26, Class: IRQMovable, EffectiveCPUs: "2", Devices: "eth0-TxRx-0"},
+		{IRQ: 28, Class: IRQManaged, EffectiveCPUs: "3", Devices: "nvme0q3"},
+	}))
+	// classifying doesn't write smp affinity
+	for _, irq := range []int{27, 28} {
+		info, err := os.Stat(irqSmpAffinityFile(dir, irq))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(info.ModTime()).To(Equal(past), "irq %d", irq)
+	}
+
+	// irq 27 accepted a change, it's movable
+	recordIRQSmpAffinityWrite(irqSmpAffinityFile(dir, 27), nil)
+	class, err := ClassifyIRQ(dir, debugDir, 27)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(class).To(Equal(IRQMovable))
+
+	reportFile := filepath.Join(debugDir, "irq_leaks")
+	g.Expect(WriteIRQLeakReport(reportFile, report)).To(Succeed())
+	saved, err := ReadIRQLeakReport(reportFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(saved).To(Equal(report))
+}
+
+func TestCheckIRQLeaksWithoutIsolatedCPUs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{24: "0000000f"})
+	defer os.RemoveAll(dir)
+
+	report, err := CheckIRQLeaks(NewCPUMask(), nil, dir, filepath.Join(dir, "debug"), filepath.Join(dir, "interrupts"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Managed).To(BeEmpty())
+	g.Expect(report.Leaks).To(BeEmpty())
+}
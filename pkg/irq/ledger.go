@@ -0,0 +1,230 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+const (
+	// CPUOwnershipLedgerFile file containing owners of isolated cpus
+	CPUOwnershipLedgerFile = IrqSmpBalanceStateDir + "/cpu_ownership_ledger"
+)
+
+// CPUOwnershipLedger keeps track of pod containers owning isolated cpus with
+// reference counting, so that a cpu is handed back to irq balancing only when
+// its last owner releases it.
+type CPUOwnershipLedger struct {
+	mu   sync.Mutex
+	file string
+	// Owners maps isolated cpu to its owners in <pod uid>/<container name> form
+	Owners map[int][]string
+}
+
+// NewCPUOwnershipLedger returns ledger backed by given file, loading the
+// owners recorded by previous run if any.
+func NewCPUOwnershipLedger(file string) (*CPUOwnershipLedger, error) {
+	l := &CPUOwnershipLedger{
+		file:   file,
+		Owners: make(map[int][]string),
+	}
+	if err := readStateFile(file, &l.Owners); err != nil {
+		return nil, err
+	}
+	metrics.IsolatedCPUs.Set(float64(len(l.Owners)))
+	return l, nil
+}
+
+// LedgerOwner returns the ledger owner name for a pod container
+func LedgerOwner(podUID, containerName string) string {
+	return podUID + "/" + containerName
+}
+
+// Acquire records containers of the given pod as owners of their assigned cpus.
+// containerCPUs maps container name to its assigned cpus. It returns the cpus
+// which had no owner before, i.e. the ones newly excluded from irq balancing.
+func (l *CPUOwnershipLedger) Acquire(podUID string, containerCPUs map[string]string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	acquired := cpuset.NewBuilder()
+	for containerName, cpus := range containerCPUs {
+		containercpuset, err := cpuset.Parse(cpus)
+		if err != nil {
+			return "", err
+		}
+		owner := LedgerOwner(podUID, containerName)
+		for _, cpu := range containercpuset.ToSlice() {
+			if len(l.Owners[cpu]) == 0 {
+				acquired.Add(cpu)
+			}
+			l.Owners[cpu] = addOwner(l.Owners[cpu], owner)
+		}
+	}
+	return acquired.Result().String(), l.persist()
+}
+
+// Release removes all containers of the given pod from the ledger. It returns
+// the cpus having no owner left, i.e. the ones to be handed back to irq balancing.
+func (l *CPUOwnershipLedger) Release(podUID string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	released := cpuset.NewBuilder()
+	for cpu, owners := range l.Owners {
+		remaining := owners[:0]
+		for _, owner := range owners {
+			if !strings.HasPrefix(owner, podUID+"/") {
+				remaining = append(remaining, owner)
+			}
+		}
+		if len(remaining) == len(owners) {
+			continue
+		}
+		if len(remaining) == 0 {
+			delete(l.Owners, cpu)
+			released.Add(cpu)
+			continue
+		}
+		l.Owners[cpu] = remaining
+	}
+	return released.Result().String(), l.persist()
+}
+
+// IsolatedCPUs returns all the cpus having at least one owner
+func (l *CPUOwnershipLedger) IsolatedCPUs() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := cpuset.NewBuilder()
+	for cpu := range l.Owners {
+		b.Add(cpu)
+	}
+	return b.Result().String()
+}
+
+// ReadLedgerIsolatedCPUs returns the cpus having at least one owner in the given
+// ledger file, for the readers other than smpaffinity such as the daemon on the host
+func ReadLedgerIsolatedCPUs(file string) (string, error) {
+	owners := make(map[int][]string)
+	if err := readStateFile(file, &owners); err != nil {
+		return "", err
+	}
+	b := cpuset.NewBuilder()
+	for cpu := range owners {
+		b.Add(cpu)
+	}
+	return b.Result().String(), nil
+}
+
+// PodUIDs returns uids of the pods owning isolated cpus
+func (l *CPUOwnershipLedger) PodUIDs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	uids := make(map[string]struct{})
+	for _, owners := range l.Owners {
+		for _, owner := range owners {
+			uids[strings.SplitN(owner, "/", 2)[0]] = struct{}{}
+		}
+	}
+	podUIDs := make([]string, 0, len(uids))
+	for uid := range uids {
+		podUIDs = append(podUIDs, uid)
+	}
+	sort.Strings(podUIDs)
+	return podUIDs
+}
+
+// ContainerCPUs returns the cpus owned by each container of the given pod, in the
+// form Acquire takes them
+func (l *CPUOwnershipLedger) ContainerCPUs(podUID string) map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	builders := make(map[string]cpuset.Builder)
+	for cpu, owners := range l.Owners {
+		for _, owner := range owners {
+			if !strings.HasPrefix(owner, podUID+"/") {
+				continue
+			}
+			containerName := strings.TrimPrefix(owner, podUID+"/")
+			b, ok := builders[containerName]
+			if !ok {
+				b = cpuset.NewBuilder()
+				builders[containerName] = b
+			}
+			b.Add(cpu)
+		}
+	}
+	containerCPUs := make(map[string]string, len(builders))
+	for containerName, b := range builders {
+		containerCPUs[containerName] = b.Result().String()
+	}
+	return containerCPUs
+}
+
+// CPUOwners returns a copy of the owners of every isolated cpu
+func (l *CPUOwnershipLedger) CPUOwners() map[int][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owners := make(map[int][]string, len(l.Owners))
+	for cpu, cpuOwners := range l.Owners {
+		owners[cpu] = append([]string(nil), cpuOwners...)
+	}
+	return owners
+}
+
+// String returns the ledger content in cpu: owners form, useful for debugging
+func (l *CPUOwnershipLedger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cpus := make([]int, 0, len(l.Owners))
+	for cpu := range l.Owners {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	entries := make([]string, 0, len(cpus))
+	for _, cpu := range cpus {
+		entries = append(entries, strconv.Itoa(cpu)+": "+strings.Join(l.Owners[cpu], ","))
+	}
+	return strings.Join(entries, "; ")
+}
+
+func addOwner(owners []string, owner string) []string {
+	for _, o := range owners {
+		if o == owner {
+			return owners
+		}
+	}
+	owners = append(owners, owner)
+	sort.Strings(owners)
+	return owners
+}
+
+func (l *CPUOwnershipLedger) persist() error {
+	metrics.IsolatedCPUs.Set(float64(len(l.Owners)))
+	return writeStateFile(l.file, l.Owners)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestCPUOwnershipLedger(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "ledger")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	ledgerFile := filepath.Join(dir, "cpu_ownership_ledger")
+
+	ledger, err := NewCPUOwnershipLedger(ledgerFile)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	acquired, err := ledger.Acquire("pod1", map[string]string{"c1": "1-2", "c2": "3"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(acquired).To(Equal("1-3"))
+
+	// pod2 gets cpus 3-4 while pod1 is still terminating
+	acquired, err = ledger.Acquire("pod2", map[string]string{"c1": "3-4"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(acquired).To(Equal("4"))
+	g.Expect(ledger.IsolatedCPUs()).To(Equal("1-4"))
+	g.Expect(ledger.PodUIDs()).To(Equal([]string{"pod1", "pod2"}))
+	g.Expect(ledger.String()).To(Equal("1: pod1/c1; 2: pod1/c1; 3: pod1/c2,pod2/c1; 4: pod2/c1"))
+	g.Expect(ledger.CPUOwners()).To(Equal(map[int][]string{
+		1: {"pod1/c1"}, 2: {"pod1/c1"}, 3: {"pod1/c2", "pod2/c1"}, 4: {"pod2/c1"},
+	}))
+	g.Expect(ledger.ContainerCPUs("pod1")).To(Equal(map[string]string{"c1": "1-2", "c2": "3"}))
+	g.Expect(ledger.ContainerCPUs("pod3")).To(BeEmpty())
+
+	// ledger survives restart
+	ledger, err = NewCPUOwnershipLedger(ledgerFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ledger.IsolatedCPUs()).To(Equal("1-4"))
+	isolated, err := ReadLedgerIsolatedCPUs(ledgerFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(isolated).To(Equal("1-4"))
+
+	released, err := ledger.Release("pod1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(released).To(Equal("1-2"))
+	g.Expect(ledger.IsolatedCPUs()).To(Equal("3-4"))
+
+	released, err = ledger.Release("pod1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(released).To(Equal(""))
+
+	released, err = ledger.Release("pod2")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(released).To(Equal("3-4"))
+	g.Expect(ledger.IsolatedCPUs()).To(Equal(""))
+
+	isolated, err = ReadLedgerIsolatedCPUs(filepath.Join(dir, "missing"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(isolated).To(Equal(""))
+}
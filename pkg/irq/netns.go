@@ -0,0 +1,98 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// HostNetNSDir directory containing named network namespaces of the host, including
+// the pod network namespaces created by cni
+const HostNetNSDir = "/host/var/run/netns"
+
+// ForEachNetworkNamespace calls fn with the interfaces directory of the host network
+// namespace, named "", and of every named network namespace in nsDir not matching
+// skip glob patterns. A network namespace failing fn is logged and skipped.
+func ForEachNetworkNamespace(hostNetDir, nsDir string, skip []string, fn func(namespace, netDir string) error) error {
+	if err := fn("", hostNetDir); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(nsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || matchesAny(skip, entry.Name()) {
+			continue
+		}
+		namespace := entry.Name()
+		err := inNetworkNamespace(filepath.Join(nsDir, namespace), func(netDir string) error {
+			return fn(namespace, netDir)
+		})
+		if err != nil {
+			logrus.Warnf("error in network namespace %s: %v", namespace, err)
+		}
+	}
+	return nil
+}
+
+// inNetworkNamespace calls fn with the interfaces directory of sysfs mounted in given
+// network namespace. It's done on a dedicated thread in a private mount namespace,
+// the thread is tainted with the namespaces so it's never unlocked and exits along
+// with its goroutine.
+func inNetworkNamespace(nsPath string, fn func(netDir string) error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errCh <- func() error {
+			fd, err := unix.Open(nsPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return err
+			}
+			defer unix.Close(fd)
+			if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+				return fmt.Errorf("error creating mount namespace: %v", err)
+			}
+			if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+				return fmt.Errorf("error making mounts private: %v", err)
+			}
+			if err := unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
+				return fmt.Errorf("error entering network namespace: %v", err)
+			}
+			dir, err := ioutil.TempDir("", "sysfs")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(dir)
+			if err := unix.Mount("sysfs", dir, "sysfs", 0, ""); err != nil {
+				return fmt.Errorf("error mounting sysfs: %v", err)
+			}
+			defer unix.Unmount(dir, unix.MNT_DETACH)
+			return fn(filepath.Join(dir, "class", "net"))
+		}()
+	}()
+	return <-errCh
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SysNodeDir directory containing numa nodes of the host
+	SysNodeDir = "/host/sys/devices/system/node"
+	// SysPCIDevicesDir directory containing pci devices of the host
+	SysPCIDevicesDir = "/host/sys/bus/pci/devices"
+)
+
+// NUMASteering steers irqs left without cpu to housekeeping cpus on the numa node of
+// their device
+type NUMASteering struct {
+	// Nodes cpus of every numa node
+	Nodes map[int]CPUMask
+	// IRQNodes numa node of every irq with a known device node
+	IRQNodes map[int]int
+	// Housekeeping cpus preferred over other cpus of the irq numa node
+	Housekeeping CPUMask
+}
+
+// ReadNUMASteering reads numa nodes from sysfs node directory, and numa node of the
+// irqs from the irq proc directory or else from their pci device.
+func ReadNUMASteering(nodeDir, pciDir, irqProcDir string) (*NUMASteering, error) {
+	nodes, err := ReadNUMANodes(nodeDir)
+	if err != nil {
+		return nil, err
+	}
+	irqNodes, err := readPCIIRQNodes(pciDir)
+	if err != nil {
+		return nil, err
+	}
+	irqs, err := ListIRQs(irqProcDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, irq := range irqs {
+		if node, ok := readNUMANode(filepath.Join(irqProcDir, strconv.Itoa(irq), "node")); ok {
+			irqNodes[irq] = node
+		}
+	}
+	return &NUMASteering{Nodes: nodes, IRQNodes: irqNodes, Housekeeping: NewCPUMask()}, nil
+}
+
+// ReadNUMANodes returns cpus of every numa node in sysfs node directory
+func ReadNUMANodes(dir string) (map[int]CPUMask, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[int]CPUMask)
+	for _, entry := range entries {
+		node, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "node"))
+		if !strings.HasPrefix(entry.Name(), "node") || err != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name(), "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		if nodes[node], err = ParseCPUList(string(content)); err != nil {
+			return nil, fmt.Errorf("invalid cpus %q of numa node %d: %v", string(content), node, err)
+		}
+	}
+	return nodes, nil
+}
+
+// Target returns the mask irq is moved to when left with remaining cpus after pod cpus
+// are removed from its mask, preferring remaining, fallback and housekeeping cpus on
+// the irq numa node in this order. crossNode is true when the irq has a numa node but
+// none of those cpus is on it, and the mask is then remaining or else fallback cpus.
+func (s *NUMASteering) Target(irq int, remaining, fallback CPUMask) (target CPUMask, crossNode bool) {
+	if remaining.IsEmpty() {
+		target = fallback
+	} else {
+		target = remaining
+	}
+	if s == nil {
+		return target, false
+	}
+	node, ok := s.IRQNodes[irq]
+	if !ok {
+		return target, false
+	}
+	local, ok := s.Nodes[node]
+	if !ok {
+		return target, false
+	}
+	for _, candidates := range []CPUMask{remaining, fallback, s.Housekeeping} {
+		if localCPUs := candidates.Intersection(local); !localCPUs.IsEmpty() {
+			return localCPUs, false
+		}
+	}
+	return target, true
+}
+
+// readPCIIRQNodes returns numa node of the msi and legacy irqs of every pci device
+// bound to a numa node
+func readPCIIRQNodes(dir string) (map[int]int, error) {
+	irqNodes := make(map[int]int)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return irqNodes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		deviceDir := filepath.Join(dir, entry.Name())
+		node, ok := readNUMANode(filepath.Join(deviceDir, "numa_node"))
+		if !ok {
+			continue
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(deviceDir, "irq")); err == nil {
+			if irq, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil && irq > 0 {
+				irqNodes[irq] = node
+			}
+		}
+		msiIRQs, err := ioutil.ReadDir(filepath.Join(deviceDir, "msi_irqs"))
+		if err != nil {
+			continue
+		}
+		for _, msiIRQ := range msiIRQs {
+			if irq, err := strconv.Atoi(msiIRQ.Name()); err == nil {
+				irqNodes[irq] = node
+			}
+		}
+	}
+	return irqNodes, nil
+}
+
+// readNUMANode reads numa node from given file, -1 means no numa node
+func readNUMANode(file string) (int, bool) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || node < 0 {
+		return 0, false
+	}
+	return node, true
+}
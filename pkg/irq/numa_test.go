@@ -0,0 +1,134 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// createNUMADirs creates sysfs node directory with nodes 0 (cpus 0-3) and 1 (cpus 4-7)
+// and pci devices directory with a nic on node 1 owning msi irqs 30 and 31
+func createNUMADirs(g *WithT) (string, string) {
+	nodeDir, err := ioutil.TempDir("", "node")
+	g.Expect(err).NotTo(HaveOccurred())
+	for node, cpus := range map[string]string{"node0": "0-3", "node1": "4-7"} {
+		g.Expect(os.Mkdir(filepath.Join(nodeDir, node), 0755)).NotTo(HaveOccurred())
+		g.Expect(ioutil.WriteFile(filepath.Join(nodeDir, node, "cpulist"), []byte(cpus+"\n"), 0644)).NotTo(HaveOccurred())
+	}
+	g.Expect(ioutil.WriteFile(filepath.Join(nodeDir, "online"), []byte("0-1\n"), 0644)).NotTo(HaveOccurred())
+
+	pciDir, err := ioutil.TempDir("", "pci")
+	g.Expect(err).NotTo(HaveOccurred())
+	for device, node := range map[string]string{"0000:3b:00.0": "1", "0000:00:1f.0": "-1"} {
+		g.Expect(os.MkdirAll(filepath.Join(pciDir, device, "msi_irqs"), 0755)).NotTo(HaveOccurred())
+		g.Expect(ioutil.WriteFile(filepath.Join(pciDir, device, "numa_node"), []byte(node+"\n"), 0644)).NotTo(HaveOccurred())
+	}
+	for _, irq := range []string{"30", "31"} {
+		g.Expect(ioutil.WriteFile(filepath.Join(pciDir, "0000:3b:00.0", "msi_irqs", irq), []byte("msix\n"), 0644)).NotTo(HaveOccurred())
+	}
+	g.Expect(ioutil.WriteFile(filepath.Join(pciDir, "0000:00:1f.0", "irq"), []byte("16\n"), 0644)).NotTo(HaveOccurred())
+	return nodeDir, pciDir
+}
+
+func TestReadNUMASteering(t *testing.T) {
+	g := NewGomegaWithT(t)
+	nodeDir, pciDir := createNUMADirs(g)
+	defer os.RemoveAll(nodeDir)
+	defer os.RemoveAll(pciDir)
+	irqDir := createIRQProcDir(g, map[int]string{16: "ff", 24: "ff", 30: "ff", 31: "ff"})
+	defer os.RemoveAll(irqDir)
+	// proc node of irq 31 takes precedence over its device node
+	g.Expect(ioutil.WriteFile(filepath.Join(irqDir, "31", "node"), []byte("0\n"), 0644)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(irqDir, "24", "node"), []byte("-1\n"), 0644)).NotTo(HaveOccurred())
+
+	steering, err := ReadNUMASteering(nodeDir, pciDir, irqDir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(steering.Nodes).To(HaveLen(2))
+	g.Expect(steering.Nodes[1].CPUList()).To(Equal("4-7"))
+	g.Expect(steering.IRQNodes).To(Equal(map[int]int{30: 1, 31: 0}))
+}
+
+func TestNUMASteeringTarget(t *testing.T) {
+	g := NewGomegaWithT(t)
+	steering := &NUMASteering{
+		Nodes:        map[int]CPUMask{0: NewCPUMask(0, 1, 2, 3), 1: NewCPUMask(4, 5, 6, 7)},
+		IRQNodes:     map[int]int{30: 1},
+		Housekeeping: NewCPUMask(0, 1, 6),
+	}
+	fallback := NewCPUMask(0, 1)
+
+	// remaining local cpus are kept
+	target, crossNode := steering.Target(30, NewCPUMask(2, 5), fallback)
+	g.Expect(target.CPUList()).To(Equal("5"))
+	g.Expect(crossNode).To(BeFalse())
+
+	// local housekeeping cpu is preferred over remote fallback
+	target, crossNode = steering.Target(30, NewCPUMask(2), fallback)
+	g.Expect(target.CPUList()).To(Equal("6"))
+	g.Expect(crossNode).To(BeFalse())
+
+	// no local cpu left
+	steering.Housekeeping = NewCPUMask(0, 1)
+	target, crossNode = steering.Target(30, NewCPUMask(), fallback)
+	g.Expect(target.CPUList()).To(Equal("0-1"))
+	g.Expect(crossNode).To(BeTrue())
+
+	// irq without numa node
+	target, crossNode = steering.Target(24, NewCPUMask(2), fallback)
+	g.Expect(target.CPUList()).To(Equal("2"))
+	g.Expect(crossNode).To(BeFalse())
+
+	var noSteering *NUMASteering
+	target, crossNode = noSteering.Target(30, NewCPUMask(), fallback)
+	g.Expect(target.CPUList()).To(Equal("0-1"))
+	g.Expect(crossNode).To(BeFalse())
+}
+
+func TestExcludeCPUsFromIRQsNUMASteering(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		30: "00000030",
+		31: "00000020",
+		32: "00000030",
+	})
+	defer os.RemoveAll(dir)
+	steering := &NUMASteering{
+		Nodes:        map[int]CPUMask{0: NewCPUMask(0, 1, 2, 3), 1: NewCPUMask(4, 5, 6, 7)},
+		IRQNodes:     map[int]int{30: 1, 31: 1, 32: 0},
+		Housekeeping: NewCPUMask(0, 1, 2, 3, 6),
+	}
+
+	status, err := ExcludeCPUsFromIRQs("4-5", "00000003", dir, steering)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Moved).To(HaveLen(3))
+	g.Expect(status.Moved[30].Applied).To(Equal("00000040"))
+	g.Expect(status.Moved[31].Applied).To(Equal("00000040"))
+	g.Expect(status.Moved[32].Applied).To(Equal("00000003"))
+	g.Expect(status.CrossNodeIRQs()).To(BeEmpty())
+
+	steering.Housekeeping = NewCPUMask(0, 1)
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "30", irqSmpAffinityFileName), []byte("00000030"), 0644)).NotTo(HaveOccurred())
+	status, err = ExcludeCPUsFromIRQs("4-5", "00000003", dir, steering)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Moved[30].Applied).To(Equal("00000003"))
+	g.Expect(status.CrossNode).To(Equal(map[int]int{30: 1}))
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HostSysClassNetDir directory containing network interfaces of the host network namespace
+	HostSysClassNetDir = "/host/sys/class/net"
+	// QueueMaskStoreFile file containing original rps and xps masks of network queues
+	QueueMaskStoreFile = IrqSmpBalanceStateDir + "/queue_masks"
+)
+
+// QueueMaskStatus outcome of changing rps and xps masks of network queues, the
+// queues are named <namespace>/<interface>/<queue>/<file>
+type QueueMaskStatus struct {
+	// Changed queues with their mask before and after the change
+	Changed map[string]IRQAffinityChange
+	// Failed queues which kernel refused to change
+	Failed map[string]error
+}
+
+// ChangedQueues returns sorted queues which were changed
+func (s *QueueMaskStatus) ChangedQueues() []string {
+	queues := make([]string, 0, len(s.Changed))
+	for queue := range s.Changed {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+// FailedQueues returns sorted queues which couldn't be changed
+func (s *QueueMaskStatus) FailedQueues() []string {
+	queues := make([]string, 0, len(s.Failed))
+	for queue := range s.Failed {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+func newQueueMaskStatus() *QueueMaskStatus {
+	return &QueueMaskStatus{
+		Changed: make(map[string]IRQAffinityChange),
+		Failed:  make(map[string]error),
+	}
+}
+
+// QueueMaskStore strips isolated cpus from rps_cpus and xps_cpus masks of network
+// queues, and keeps their original masks in a file to restore them later.
+type QueueMaskStore struct {
+	mu   sync.Mutex
+	file string
+	// SkipInterfaces glob patterns of interfaces left untouched
+	SkipInterfaces []string
+	// Originals maps queue to its mask before the isolated cpus were stripped
+	Originals map[string]string
+}
+
+// NewQueueMaskStore returns queue mask store backed by given file, loading the
+// original masks recorded by previous run if any.
+func NewQueueMaskStore(file string, skipInterfaces []string) (*QueueMaskStore, error) {
+	s := &QueueMaskStore{
+		file:           file,
+		SkipInterfaces: skipInterfaces,
+		Originals:      make(map[string]string),
+	}
+	if err := readStateFile(file, &s.Originals); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Exclude removes given cpus from rps and xps masks of every queue of the interfaces
+// in netDir of given network namespace, an empty namespace being the host one.
+func (s *QueueMaskStore) Exclude(namespace, netDir string, cpus CPUMask) (*QueueMaskStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := newQueueMaskStatus()
+	files, err := s.queueMaskFiles(netDir)
+	if err != nil {
+		return status, err
+	}
+	for _, file := range files {
+		queue := queueName(namespace, netDir, file)
+		current, err := RetrieveCPUMask(file)
+		if err != nil {
+			// xps_cpus isn't readable on single queue devices
+			continue
+		}
+		currentmask, err := ParseCPUMask(current)
+		if err != nil || currentmask.Intersection(cpus).IsEmpty() {
+			continue
+		}
+		newMask := currentmask.Difference(cpus).Format(maskWidth(current))
+		if err := ioutil.WriteFile(file, []byte(newMask), 0o644); err != nil {
+			status.Failed[queue] = err
+			continue
+		}
+		if _, ok := s.Originals[queue]; !ok {
+			s.Originals[queue] = current
+		}
+		status.Changed[queue] = IRQAffinityChange{Original: current, Applied: newMask}
+	}
+	return status, s.persist()
+}
+
+// Restore adds given cpus back to rps and xps masks of the queues of given network
+// namespace which had them originally. A queue is forgotten once its original mask
+// is fully restored or the queue is gone.
+func (s *QueueMaskStore) Restore(namespace, netDir string, cpus CPUMask) (*QueueMaskStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := newQueueMaskStatus()
+	prefix := namespace + "/"
+	for _, queue := range sortedStrings(s.Originals) {
+		if !strings.HasPrefix(queue, prefix) {
+			continue
+		}
+		file := filepath.Join(netDir, strings.TrimPrefix(queue, prefix))
+		current, err := RetrieveCPUMask(file)
+		if err != nil {
+			logrus.Infof("queue %s is gone, forgetting its original mask", queue)
+			delete(s.Originals, queue)
+			continue
+		}
+		currentmask, err := ParseCPUMask(current)
+		if err != nil {
+			continue
+		}
+		originalmask, err := ParseCPUMask(s.Originals[queue])
+		if err != nil {
+			delete(s.Originals, queue)
+			continue
+		}
+		restoredmask := currentmask.Union(originalmask.Intersection(cpus))
+		if !restoredmask.Equals(currentmask) {
+			newMask := restoredmask.Format(maskWidth(current))
+			if err := ioutil.WriteFile(file, []byte(newMask), 0o644); err != nil {
+				status.Failed[queue] = err
+				continue
+			}
+			status.Changed[queue] = IRQAffinityChange{Original: current, Applied: newMask}
+		}
+		if originalmask.IsSubsetOf(restoredmask) {
+			delete(s.Originals, queue)
+		}
+	}
+	return status, s.persist()
+}
+
+// Namespaces returns the network namespaces having queues with original masks
+func (s *QueueMaskStore) Namespaces() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespaces := make(map[string]string)
+	for queue := range s.Originals {
+		namespace := strings.SplitN(queue, "/", 2)[0]
+		namespaces[namespace] = namespace
+	}
+	return sortedStrings(namespaces)
+}
+
+// Forget drops original masks of the queues of given network namespace, e.g. once
+// the namespace is gone
+func (s *QueueMaskStore) Forget(namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for queue := range s.Originals {
+		if strings.HasPrefix(queue, namespace+"/") {
+			delete(s.Originals, queue)
+		}
+	}
+	return s.persist()
+}
+
+// queueMaskFiles returns rps_cpus and xps_cpus files of the interfaces in netDir
+// which are not skipped
+func (s *QueueMaskStore) queueMaskFiles(netDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(netDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if matchesAny(s.SkipInterfaces, entry.Name()) {
+			continue
+		}
+		for _, pattern := range []string{"rx-*/rps_cpus", "tx-*/xps_cpus"} {
+			matches, err := filepath.Glob(filepath.Join(netDir, entry.Name(), "queues", pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *QueueMaskStore) persist() error {
+	return writeStateFile(s.file, s.Originals)
+}
+
+// queueName returns the queue name of a mask file in netDir of the network namespace
+func queueName(namespace, netDir, file string) string {
+	rel, err := filepath.Rel(netDir, file)
+	if err != nil {
+		rel = file
+	}
+	return namespace + "/" + rel
+}
+
+// matchesAny returns true if name matches any of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedStrings(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// createNetDir creates interfaces directory with given queue mask files relative to it
+func createNetDir(g *WithT, masks map[string]string) string {
+	dir, err := ioutil.TempDir("", "net")
+	g.Expect(err).NotTo(HaveOccurred())
+	for file, mask := range masks {
+		g.Expect(os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755)).NotTo(HaveOccurred())
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, file), []byte(mask+"\n"), 0644)).NotTo(HaveOccurred())
+	}
+	return dir
+}
+
+func readQueueMask(g *WithT, dir, file string) string {
+	mask, err := RetrieveCPUMask(filepath.Join(dir, file))
+	g.Expect(err).NotTo(HaveOccurred())
+	return mask
+}
+
+func TestQueueMaskStore(t *testing.T) {
+	g := NewGomegaWithT(t)
+	netDir := createNetDir(g, map[string]string{
+		"eth0/queues/rx-0/rps_cpus": "000000ff",
+		"eth0/queues/rx-1/rps_cpus": "00000000",
+		"eth0/queues/tx-0/xps_cpus": "00000006",
+		"lo/queues/rx-0/rps_cpus":   "000000ff",
+	})
+	defer os.RemoveAll(netDir)
+	storeFile := filepath.Join(netDir, "queue_masks")
+
+	store, err := NewQueueMaskStore(storeFile, []string{"lo"})
+	g.Expect(err).NotTo(HaveOccurred())
+	status, err := store.Exclude("", netDir, NewCPUMask(1, 2))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.ChangedQueues()).To(Equal([]string{"/eth0/queues/rx-0/rps_cpus", "/eth0/queues/tx-0/xps_cpus"}))
+	g.Expect(readQueueMask(g, netDir, "eth0/queues/rx-0/rps_cpus")).To(Equal("000000f9"))
+	g.Expect(readQueueMask(g, netDir, "eth0/queues/tx-0/xps_cpus")).To(Equal("00000000"))
+	// skipped interface and queue without rps are left alone
+	g.Expect(readQueueMask(g, netDir, "lo/queues/rx-0/rps_cpus")).To(Equal("000000ff"))
+	g.Expect(readQueueMask(g, netDir, "eth0/queues/rx-1/rps_cpus")).To(Equal("00000000"))
+
+	// original masks survive restart, and further isolation keeps them
+	store, err = NewQueueMaskStore(storeFile, []string{"lo"})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.Exclude("", netDir, NewCPUMask(3))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Originals).To(Equal(map[string]string{
+		"/eth0/queues/rx-0/rps_cpus": "000000ff",
+		"/eth0/queues/tx-0/xps_cpus": "00000006",
+	}))
+	g.Expect(store.Namespaces()).To(Equal([]string{""}))
+
+	_, err = store.Restore("", netDir, NewCPUMask(1, 2))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(readQueueMask(g, netDir, "eth0/queues/rx-0/rps_cpus")).To(Equal("000000f7"))
+	g.Expect(readQueueMask(g, netDir, "eth0/queues/tx-0/xps_cpus")).To(Equal("00000006"))
+	g.Expect(store.Originals).To(HaveLen(1))
+
+	_, err = store.Restore("", netDir, NewCPUMask(3))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(readQueueMask(g, netDir, "eth0/queues/rx-0/rps_cpus")).To(Equal("000000ff"))
+	g.Expect(store.Originals).To(BeEmpty())
+}
+
+func TestQueueMaskStoreForget(t *testing.T) {
+	g := NewGomegaWithT(t)
+	netDir := createNetDir(g, map[string]string{"eth0/queues/rx-0/rps_cpus": "0000000f"})
+	defer os.RemoveAll(netDir)
+
+	store, err := NewQueueMaskStore(filepath.Join(netDir, "queue_masks"), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.Exclude("", netDir, NewCPUMask(1))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.Exclude("cni-1234", netDir, NewCPUMask(2))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Namespaces()).To(Equal([]string{"", "cni-1234"}))
+
+	g.Expect(store.Forget("cni-1234")).NotTo(HaveOccurred())
+	g.Expect(store.Namespaces()).To(Equal([]string{""}))
+}
+
+func TestForEachNetworkNamespaceHostOnly(t *testing.T) {
+	g := NewGomegaWithT(t)
+	netDir := createNetDir(g, map[string]string{"eth0/queues/rx-0/rps_cpus": "0000000f"})
+	defer os.RemoveAll(netDir)
+
+	var visited []string
+	err := ForEachNetworkNamespace(netDir, filepath.Join(netDir, "missing"), nil, func(namespace, dir string) error {
+		g.Expect(dir).To(Equal(netDir))
+		visited = append(visited, namespace)
+		return nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(visited).To(Equal([]string{""}))
+}
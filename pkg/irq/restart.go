@@ -0,0 +1,169 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// RestartMethod is a way of restarting irqbalance with new banned cpus
+type RestartMethod string
+
+const (
+	// RestartMethodDBus restarts irqbalance systemd unit through systemd D-Bus API
+	RestartMethodDBus RestartMethod = "dbus"
+	// RestartMethodService restarts irqbalance with service command
+	RestartMethodService RestartMethod = "service"
+	// RestartMethodOneshot runs irqbalance --oneshot, which balances the irqs once and
+	// leaves no irqbalance daemon running
+	RestartMethodOneshot RestartMethod = "oneshot"
+
+	// IrqBalanceUnit irqbalance systemd unit name
+	IrqBalanceUnit = "irqbalance.service"
+	// DefaultIRQBalanceRestartPolicy methods tried in order until one succeeds
+	DefaultIRQBalanceRestartPolicy = "dbus,service,oneshot"
+	// DefaultIRQBalanceRestartTimeout time given to each restart method
+	DefaultIRQBalanceRestartTimeout = 30 * time.Second
+)
+
+// irqBalanceRestarters implement the restart methods, overridden in tests
+var irqBalanceRestarters = map[RestartMethod]func(config IRQBalanceConfig, bannedCPUMask string) error{
+	RestartMethodDBus:    restartIRQBalanceDBus,
+	RestartMethodService: restartIRQBalanceService,
+	RestartMethodOneshot: runIRQBalanceOneshot,
+}
+
+// ParseRestartPolicy returns restart methods for comma separated list of method names
+func ParseRestartPolicy(policy string) ([]RestartMethod, error) {
+	var methods []RestartMethod
+	for _, name := range strings.Split(policy, ",") {
+		method := RestartMethod(strings.TrimSpace(name))
+		if _, ok := irqBalanceRestarters[method]; !ok {
+			return nil, fmt.Errorf("invalid irqbalance restart method %q, must be one of %s, %s or %s", name,
+				RestartMethodDBus, RestartMethodService, RestartMethodOneshot)
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// restartIRQBalance tries the restart methods of config restart policy in order until
+// one succeeds
+func restartIRQBalance(config IRQBalanceConfig, bannedCPUMask string) error {
+	if len(config.RestartPolicy) == 0 {
+		return fmt.Errorf("no irqbalance restart method configured")
+	}
+	var errs []string
+	for _, method := range config.RestartPolicy {
+		start := time.Now()
+		err := irqBalanceRestarters[method](config, bannedCPUMask)
+		metrics.IRQBalanceRestartDuration.WithLabelValues(string(method)).Observe(time.Since(start).Seconds())
+		if err == nil {
+			metrics.IRQBalanceRestarts.WithLabelValues(string(method), "success").Inc()
+			logrus.Infof("irqbalance is restarted with %s method", method)
+			return nil
+		}
+		metrics.IRQBalanceRestarts.WithLabelValues(string(method), "failure").Inc()
+		logrus.Errorf("error restarting irqbalance with %s method: %v", method, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", method, err))
+	}
+	return fmt.Errorf("irqbalance restart failed: %s", strings.Join(errs, "; "))
+}
+
+func (c IRQBalanceConfig) restartTimeout() time.Duration {
+	if c.RestartTimeout <= 0 {
+		return DefaultIRQBalanceRestartTimeout
+	}
+	return c.RestartTimeout
+}
+
+// restartIRQBalanceDBus restarts irqbalance unit and waits for the job result, the
+// unit state is logged when the job doesn't complete successfully.
+func restartIRQBalanceDBus(config IRQBalanceConfig, _ string) error {
+	conn, err := dbus.NewSystemConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	result := make(chan string, 1)
+	if _, err := conn.RestartUnit(IrqBalanceUnit, "replace", result); err != nil {
+		return err
+	}
+	select {
+	case r := <-result:
+		if r == "done" {
+			return nil
+		}
+		logIRQBalanceUnitState(conn)
+		return fmt.Errorf("restart job of %s finished with result %s", IrqBalanceUnit, r)
+	case <-time.After(config.restartTimeout()):
+		logIRQBalanceUnitState(conn)
+		return fmt.Errorf("restart job of %s timed out after %v", IrqBalanceUnit, config.restartTimeout())
+	}
+}
+
+func logIRQBalanceUnitState(conn *dbus.Conn) {
+	unit, err := conn.GetUnitProperties(IrqBalanceUnit)
+	if err != nil {
+		logrus.Errorf("error retrieving %s state: %v", IrqBalanceUnit, err)
+		return
+	}
+	service, err := conn.GetUnitTypeProperties(IrqBalanceUnit, "Service")
+	if err != nil {
+		logrus.Errorf("error retrieving %s service state: %v", IrqBalanceUnit, err)
+		return
+	}
+	logrus.Errorf("%s is %v (%v), result %v, main process exit code %v status %v", IrqBalanceUnit,
+		unit["ActiveState"], unit["SubState"], service["Result"], service["ExecMainCode"], service["ExecMainStatus"])
+}
+
+func restartIRQBalanceService(config IRQBalanceConfig, _ string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.restartTimeout())
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "service", "irqbalance", "restart").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func runIRQBalanceOneshot(config IRQBalanceConfig, bannedCPUMask string) error {
+	value, err := config.bannedCPUsValue(bannedCPUMask)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.restartTimeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "irqbalance", "--oneshot")
+	cmd.Env = append(os.Environ(), config.BannedCPUsKey()+"="+value)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	logrus.Warnf("irqbalance balanced the irqs once, no irqbalance daemon is running")
+	return nil
+}
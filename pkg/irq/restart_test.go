@@ -0,0 +1,74 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/pperiyasamy/irq-smp-balance/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+	methods, err := ParseRestartPolicy(DefaultIRQBalanceRestartPolicy)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(methods).To(Equal([]RestartMethod{RestartMethodDBus, RestartMethodService, RestartMethodOneshot}))
+	methods, err = ParseRestartPolicy("service, dbus")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(methods).To(Equal([]RestartMethod{RestartMethodService, RestartMethodDBus}))
+	_, err = ParseRestartPolicy("dbus,kill")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestRestartIRQBalanceFallback(t *testing.T) {
+	g := NewGomegaWithT(t)
+	restarters := irqBalanceRestarters
+	defer func() { irqBalanceRestarters = restarters }()
+
+	var tried []RestartMethod
+	fake := func(method RestartMethod, err error) func(IRQBalanceConfig, string) error {
+		return func(IRQBalanceConfig, string) error {
+			tried = append(tried, method)
+			return err
+		}
+	}
+	irqBalanceRestarters = map[RestartMethod]func(IRQBalanceConfig, string) error{
+		RestartMethodDBus:    fake(RestartMethodDBus, fmt.Errorf("no system bus")),
+		RestartMethodService: fake(RestartMethodService, nil),
+		RestartMethodOneshot: fake(RestartMethodOneshot, nil),
+	}
+
+	failures := testutil.ToFloat64(metrics.IRQBalanceRestarts.WithLabelValues(string(RestartMethodDBus), "failure"))
+	successes := testutil.ToFloat64(metrics.IRQBalanceRestarts.WithLabelValues(string(RestartMethodService), "success"))
+	config := IRQBalanceConfig{RestartPolicy: []RestartMethod{RestartMethodDBus, RestartMethodService, RestartMethodOneshot}}
+	g.Expect(restartIRQBalance(config, "00000006")).NotTo(HaveOccurred())
+	g.Expect(tried).To(Equal([]RestartMethod{RestartMethodDBus, RestartMethodService}))
+	g.Expect(testutil.ToFloat64(metrics.IRQBalanceRestarts.WithLabelValues(string(RestartMethodDBus), "failure"))).To(Equal(failures + 1))
+	g.Expect(testutil.ToFloat64(metrics.IRQBalanceRestarts.WithLabelValues(string(RestartMethodService), "success"))).To(Equal(successes + 1))
+
+	// oneshot left out of the policy so that a failed restart is reported instead
+	tried = nil
+	config.RestartPolicy = []RestartMethod{RestartMethodDBus}
+	err := restartIRQBalance(config, "00000006")
+	g.Expect(err).To(MatchError("irqbalance restart failed: dbus: no system bus"))
+	g.Expect(tried).To(Equal([]RestartMethod{RestartMethodDBus}))
+
+	g.Expect(restartIRQBalance(IRQBalanceConfig{}, "00000006")).To(HaveOccurred())
+}
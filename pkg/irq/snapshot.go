@@ -0,0 +1,280 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+const (
+	// IrqAffinitySnapshotFile file containing per pod irq affinity snapshots
+	IrqAffinitySnapshotFile = IrqSmpBalanceStateDir + "/irq_affinity_snapshot"
+)
+
+// IRQAffinitySnapshot smp affinity masks of irqs moved off the cpus of a pod, and of
+// the pod device irqs pinned to the pod cpus
+type IRQAffinitySnapshot struct {
+	CPUs   string                    `json:"cpus"`
+	IRQs   map[int]IRQAffinityChange `json:"irqs"`
+	Pinned map[int]IRQAffinityChange `json:"pinned,omitempty"`
+}
+
+// IRQAffinitySnapshotStore keeps irq affinity snapshots of isolated pods in a file
+type IRQAffinitySnapshotStore struct {
+	mu        sync.Mutex
+	file      string
+	Snapshots map[string]*IRQAffinitySnapshot
+}
+
+// NewIRQAffinitySnapshotStore returns snapshot store backed by given file, loading
+// the snapshots saved by previous run if any.
+func NewIRQAffinitySnapshotStore(file string) (*IRQAffinitySnapshotStore, error) {
+	s := &IRQAffinitySnapshotStore{
+		file:      file,
+		Snapshots: make(map[string]*IRQAffinitySnapshot),
+	}
+	if err := readStateFile(file, &s.Snapshots); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save records irqs moved off the cpus of given pod. When the pod already has
+// a snapshot, the original mask recorded first is retained.
+func (s *IRQAffinitySnapshotStore) Save(podUID, cpus string, status *IRQAffinityStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	podcpuset, err := cpuset.Parse(cpus)
+	if err != nil {
+		return err
+	}
+	snapshot, ok := s.Snapshots[podUID]
+	if !ok {
+		snapshot = &IRQAffinitySnapshot{IRQs: make(map[int]IRQAffinityChange)}
+		s.Snapshots[podUID] = snapshot
+	} else if savedcpuset, err := cpuset.Parse(snapshot.CPUs); err == nil {
+		podcpuset = podcpuset.Union(savedcpuset)
+	}
+	snapshot.CPUs = podcpuset.String()
+	for irq, change := range status.Moved {
+		if saved, ok := snapshot.IRQs[irq]; ok {
+			change.Original = saved.Original
+		}
+		snapshot.IRQs[irq] = change
+	}
+	return s.persist()
+}
+
+// SavePinned records device irqs pinned to the cpus of given pod. When an irq is
+// already pinned, the original mask recorded first is retained.
+func (s *IRQAffinitySnapshotStore) SavePinned(podUID string, status *IRQAffinityStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot, ok := s.Snapshots[podUID]
+	if !ok {
+		snapshot = &IRQAffinitySnapshot{IRQs: make(map[int]IRQAffinityChange)}
+		s.Snapshots[podUID] = snapshot
+	}
+	if snapshot.Pinned == nil {
+		snapshot.Pinned = make(map[int]IRQAffinityChange)
+	}
+	for irq, change := range status.Moved {
+		if saved, ok := snapshot.Pinned[irq]; ok {
+			change.Original = saved.Original
+		}
+		snapshot.Pinned[irq] = change
+	}
+	return s.persist()
+}
+
+// PinnedIRQs returns sorted device irqs pinned to the cpus of any pod
+func (s *IRQAffinitySnapshotStore) PinnedIRQs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var irqs []int
+	for _, snapshot := range s.Snapshots {
+		for irq := range snapshot.Pinned {
+			irqs = append(irqs, irq)
+		}
+	}
+	sort.Ints(irqs)
+	return irqs
+}
+
+// ReadPinnedIRQs returns sorted device irqs pinned to the cpus of any pod in the given
+// snapshot file, for the readers other than smpaffinity such as the daemon on the host
+func ReadPinnedIRQs(file string) ([]int, error) {
+	s, err := NewIRQAffinitySnapshotStore(file)
+	if err != nil {
+		return nil, err
+	}
+	return s.PinnedIRQs(), nil
+}
+
+// RestorePinned gives device irqs pinned to the cpus of given pod their mask from
+// before the pinning back, unless the mask is changed since then. It's to be called
+// before the pod cpus are restored, which restore the mask from before the isolation.
+func (s *IRQAffinitySnapshotStore) RestorePinned(podUID, irqProcDir string) (*IRQAffinityStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := newIRQAffinityStatus()
+	snapshot, ok := s.Snapshots[podUID]
+	if !ok || len(snapshot.Pinned) == 0 {
+		return status, nil
+	}
+	threads := listIRQThreads()
+	for irq, change := range snapshot.Pinned {
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		if err != nil {
+			// irq is gone meanwhile, e.g. the vf is released
+			continue
+		}
+		if !masksEqual(current, change.Applied) {
+			logrus.Infof("smp affinity of pinned irq %d is changed to %s meanwhile, leaving it", irq, current)
+			continue
+		}
+		if err := writeIRQSmpAffinity(irqProcDir, irq, change.Original); err != nil {
+			status.Failed[irq] = err
+			continue
+		}
+		status.Moved[irq] = IRQAffinityChange{Original: current, Applied: change.Original}
+		threads.follow(irq, change.Original, status)
+	}
+	snapshot.Pinned = nil
+	if snapshot.CPUs == "" && len(snapshot.IRQs) == 0 {
+		delete(s.Snapshots, podUID)
+	}
+	return status, s.persist()
+}
+
+// Restore plays back irq affinity snapshots for the given cpus which are no longer
+// isolated. A snapshot is removed from the store once all of its cpus are restored,
+// cpus of a deleted pod may still be held by another pod and restored later.
+// An irq still having the mask applied at isolation time gets its original mask
+// back. Otherwise the mask is changed since then (e.g. by irqbalance), so only the
+// restored cpus from the original mask are added to the current one.
+func (s *IRQAffinitySnapshotStore) Restore(cpus, irqProcDir string) (*IRQAffinityStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := newIRQAffinityStatus()
+	restoredcpuset, err := cpuset.Parse(cpus)
+	if err != nil {
+		return status, err
+	}
+	podUIDs := make([]string, 0, len(s.Snapshots))
+	for podUID := range s.Snapshots {
+		podUIDs = append(podUIDs, podUID)
+	}
+	sort.Strings(podUIDs)
+	threads := listIRQThreads()
+	for _, podUID := range podUIDs {
+		snapshot := s.Snapshots[podUID]
+		podcpuset, err := cpuset.Parse(snapshot.CPUs)
+		if err != nil {
+			logrus.Warnf("dropping irq affinity snapshot of pod %s with invalid cpus %s", podUID, snapshot.CPUs)
+			delete(s.Snapshots, podUID)
+			continue
+		}
+		freedcpuset := podcpuset.Intersection(restoredcpuset)
+		if freedcpuset.IsEmpty() {
+			continue
+		}
+		remainingcpuset := podcpuset.Difference(freedcpuset)
+		snapshot.restore(freedcpuset, remainingcpuset.IsEmpty(), irqProcDir, threads, status)
+		if remainingcpuset.IsEmpty() {
+			delete(s.Snapshots, podUID)
+			continue
+		}
+		snapshot.CPUs = remainingcpuset.String()
+	}
+	if len(status.Failed) > 0 {
+		logrus.Warnf("kernel refused to restore irqs %v on cpus %s", status.FailedIRQs(), cpus)
+	}
+	return status, s.persist()
+}
+
+// restore adds freed cpus back to the irqs of the snapshot. When it's the last
+// restore of the snapshot, irqs untouched since isolation get their original mask.
+func (snapshot *IRQAffinitySnapshot) restore(freedcpuset cpuset.CPUSet, last bool, irqProcDir string,
+	threads irqThreads, status *IRQAffinityStatus) {
+	irqs := make([]int, 0, len(snapshot.IRQs))
+	for irq := range snapshot.IRQs {
+		irqs = append(irqs, irq)
+	}
+	sort.Ints(irqs)
+	for _, irq := range irqs {
+		change := snapshot.IRQs[irq]
+		current, err := RetrieveIRQSmpAffinity(irqProcDir, irq)
+		if err != nil {
+			// irq is gone meanwhile
+			delete(snapshot.IRQs, irq)
+			continue
+		}
+		restoredMask, err := mergeIRQSmpAffinity(current, change, freedcpuset, last)
+		if err != nil {
+			logrus.Warnf("error restoring smp affinity of irq %d: %v", irq, err)
+			continue
+		}
+		if restoredMask != current {
+			if err := writeIRQSmpAffinity(irqProcDir, irq, restoredMask); err != nil {
+				status.Failed[irq] = err
+				continue
+			}
+			status.Moved[irq] = IRQAffinityChange{Original: current, Applied: restoredMask}
+			threads.follow(irq, restoredMask, status)
+		}
+		change.Applied = restoredMask
+		snapshot.IRQs[irq] = change
+	}
+}
+
+// mergeIRQSmpAffinity returns the mask to be restored for an irq having current mask
+func mergeIRQSmpAffinity(current string, change IRQAffinityChange, freedcpuset cpuset.CPUSet, last bool) (string, error) {
+	currentmask, err := ParseCPUMask(current)
+	if err != nil {
+		return "", err
+	}
+	appliedmask, err := ParseCPUMask(change.Applied)
+	if err != nil {
+		return "", err
+	}
+	if last && currentmask.Equals(appliedmask) {
+		return change.Original, nil
+	}
+	originalmask, err := ParseCPUMask(change.Original)
+	if err != nil {
+		return "", err
+	}
+	missingmask := originalmask.Intersection(NewCPUMaskFromCPUSet(freedcpuset)).Difference(currentmask)
+	if missingmask.IsEmpty() {
+		return current, nil
+	}
+	return currentmask.Union(missingmask).Format(maskWidth(current)), nil
+}
+
+func (s *IRQAffinitySnapshotStore) persist() error {
+	return writeStateFile(s.file, s.Snapshots)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+const testPodUID = "8631b3ef-066d-4723-a4b2-797d9d095c4f"
+
+func TestIRQAffinitySnapshotRestore(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		24: "00000000,000000ff",
+		25: "00000000,00000006",
+		26: "00000000,0000000f",
+	})
+	defer os.RemoveAll(dir)
+	snapshotFile := filepath.Join(dir, "state", "irq_affinity_snapshot")
+
+	store, err := NewIRQAffinitySnapshotStore(snapshotFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	status, err := ExcludeCPUsFromIRQs("1-2", "00000000,000000f9", dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Save(testPodUID, "1-2", status)).NotTo(HaveOccurred())
+
+	// snapshot survives restart
+	store, err = NewIRQAffinitySnapshotStore(snapshotFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Snapshots).To(HaveKey(testPodUID))
+	g.Expect(store.Snapshots[testPodUID].IRQs).To(HaveLen(3))
+
+	// irq 26 is moved meanwhile by somebody else
+	g.Expect(ioutil.WriteFile(irqSmpAffinityFile(dir, 26), []byte("00000000,00000030"), 0644)).NotTo(HaveOccurred())
+
+	status, err = store.Restore("1-2", dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Failed).To(BeEmpty())
+	g.Expect(store.Snapshots).NotTo(HaveKey(testPodUID))
+
+	mask, err := RetrieveIRQSmpAffinity(dir, 24)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000ff"))
+
+	mask, err = RetrieveIRQSmpAffinity(dir, 25)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,00000006"))
+
+	// only pod cpus are merged into the current mask
+	mask, err = RetrieveIRQSmpAffinity(dir, 26)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,00000036"))
+
+	// restoring cpus without snapshot is a no-op
+	status, err = store.Restore("3", dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Moved).To(BeEmpty())
+}
+
+func TestIRQAffinitySnapshotPartialRestore(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		24: "00000000,000000ff",
+		25: "00000000,00000006",
+	})
+	defer os.RemoveAll(dir)
+
+	store, err := NewIRQAffinitySnapshotStore(filepath.Join(dir, "irq_affinity_snapshot"))
+	g.Expect(err).NotTo(HaveOccurred())
+	status, err := ExcludeCPUsFromIRQs("1-2", "00000000,000000f9", dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Save(testPodUID, "1-2", status)).NotTo(HaveOccurred())
+
+	// cpu 2 is still held by another pod
+	_, err = store.Restore("1", dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Snapshots[testPodUID].CPUs).To(Equal("2"))
+
+	mask, err := RetrieveIRQSmpAffinity(dir, 24)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000fb"))
+	mask, err = RetrieveIRQSmpAffinity(dir, 25)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000fb"))
+
+	_, err = store.Restore("2", dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Snapshots).To(BeEmpty())
+
+	mask, err = RetrieveIRQSmpAffinity(dir, 24)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000ff"))
+	mask, err = RetrieveIRQSmpAffinity(dir, 25)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,00000006"))
+}
+
+func TestIRQAffinitySnapshotRestorePinned(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createIRQProcDir(g, map[int]string{
+		30: "00000000,000000ff",
+		31: "00000000,000000ff",
+	})
+	defer os.RemoveAll(dir)
+	snapshotFile := filepath.Join(dir, "irq_affinity_snapshot")
+
+	store, err := NewIRQAffinitySnapshotStore(snapshotFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	status, err := ExcludeCPUsFromIRQs("1-2", "00000000,000000f9", dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Save(testPodUID, "1-2", status)).NotTo(HaveOccurred())
+	status = PinIRQs([]int{30, 31}, NewCPUMask(2), dir)
+	g.Expect(store.SavePinned(testPodUID, status)).NotTo(HaveOccurred())
+
+	// pinned irqs survive restart
+	store, err = NewIRQAffinitySnapshotStore(snapshotFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Snapshots[testPodUID].Pinned).To(HaveLen(2))
+	pinned, err := ReadPinnedIRQs(snapshotFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pinned).To(Equal([]int{30, 31}))
+
+	// irq 31 is moved meanwhile by somebody else
+	g.Expect(ioutil.WriteFile(irqSmpAffinityFile(dir, 31), []byte("00000000,00000010"), 0644)).NotTo(HaveOccurred())
+
+	status, err = store.RestorePinned(testPodUID, dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.MovedIRQs()).To(Equal([]int{30}))
+	mask, err := RetrieveIRQSmpAffinity(dir, 30)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000f9"))
+
+	_, err = store.Restore("1-2", dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Snapshots).To(BeEmpty())
+	mask, err = RetrieveIRQSmpAffinity(dir, 30)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mask).To(Equal("00000000,000000ff"))
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// IrqBalanceSocketDir directory containing irqbalance control socket, irqbalance 1.5
+	// or newer listens on irqbalance<pid>.sock in there
+	IrqBalanceSocketDir = "/run/irqbalance"
+
+	irqBalanceSocketTimeout = 5 * time.Second
+	// irqbalance applies new banned cpus at next rescan, i.e. within its 10s interval
+	irqBalanceSocketVerifyTimeout  = 15 * time.Second
+	irqBalanceSocketVerifyInterval = time.Second
+)
+
+// ErrIRQBalanceSocketNotFound no running irqbalance listens on a control socket
+var ErrIRQBalanceSocketNotFound = errors.New("irqbalance control socket not found")
+
+// IRQBalanceSocket client for irqbalance control socket, used to update banned cpus
+// of the running irqbalance without restarting it.
+type IRQBalanceSocket struct {
+	dir            string
+	timeout        time.Duration
+	verifyTimeout  time.Duration
+	verifyInterval time.Duration
+}
+
+// NewIRQBalanceSocket returns irqbalance control socket client looking for the socket
+// in given directory
+func NewIRQBalanceSocket(dir string) *IRQBalanceSocket {
+	return &IRQBalanceSocket{
+		dir:            dir,
+		timeout:        irqBalanceSocketTimeout,
+		verifyTimeout:  irqBalanceSocketVerifyTimeout,
+		verifyInterval: irqBalanceSocketVerifyInterval,
+	}
+}
+
+// Path returns control socket path of the running irqbalance
+func (s *IRQBalanceSocket) Path() (string, error) {
+	sockets, err := filepath.Glob(filepath.Join(s.dir, "irqbalance*.sock"))
+	if err != nil {
+		return "", err
+	}
+	for _, socket := range sockets {
+		pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(socket), "irqbalance"), ".sock"))
+		if err != nil {
+			continue
+		}
+		// socket of a crashed irqbalance is left behind
+		if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+			continue
+		}
+		return socket, nil
+	}
+	return "", ErrIRQBalanceSocketNotFound
+}
+
+// SetBannedCPUs pushes banned cpus mask to the running irqbalance and reads it back
+// to confirm irqbalance is using it.
+func (s *IRQBalanceSocket) SetBannedCPUs(bannedCPUMask string) error {
+	bannedmask, err := ParseCPUMask(bannedCPUMask)
+	if err != nil {
+		return err
+	}
+	cpuList := "NULL"
+	if !bannedmask.IsEmpty() {
+		cpuList = bannedmask.CPUList()
+	}
+	if _, err := s.send("settings cpus " + cpuList); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(s.verifyTimeout)
+	for {
+		current, err := s.BannedCPUs()
+		if err != nil {
+			return err
+		}
+		if masksEqual(current, bannedCPUMask) {
+			logrus.Infof("irqbalance banned cpus are set to %s through control socket", bannedCPUMask)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("irqbalance banned cpus are %s instead of %s", current, bannedCPUMask)
+		}
+		time.Sleep(s.verifyInterval)
+	}
+}
+
+// BannedCPUs returns the banned cpus mask in use by the running irqbalance
+func (s *IRQBalanceSocket) BannedCPUs() (string, error) {
+	setup, err := s.send("setup")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(setup)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "BANNED" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no banned cpus in irqbalance setup %q", setup)
+}
+
+// SetBannedIRQs makes the running irqbalance leave given irqs alone, replacing the
+// irqs banned before, and reads them back to confirm irqbalance is using them.
+func (s *IRQBalanceSocket) SetBannedIRQs(irqs []int) error {
+	irqList := "NONE"
+	if len(irqs) > 0 {
+		irqList = joinIRQs(irqs)
+	}
+	if _, err := s.send("settings ban irqs " + irqList); err != nil {
+		return err
+	}
+	current, err := s.BannedIRQs()
+	if err != nil {
+		return err
+	}
+	if joinIRQs(current) != joinIRQs(irqs) {
+		return fmt.Errorf("irqbalance banned irqs are %v instead of %v", current, irqs)
+	}
+	logrus.Infof("irqbalance banned irqs are set to %v through control socket", irqs)
+	return nil
+}
+
+// BannedIRQs returns sorted irqs the running irqbalance leaves alone
+func (s *IRQBalanceSocket) BannedIRQs() ([]int, error) {
+	setup, err := s.send("setup")
+	if err != nil {
+		return nil, err
+	}
+	irqs := []int{}
+	fields := strings.Fields(setup)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "IRQ" {
+			continue
+		}
+		irq, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid banned irq in irqbalance setup %q", setup)
+		}
+		irqs = append(irqs, irq)
+	}
+	sort.Ints(irqs)
+	return irqs, nil
+}
+
+func joinIRQs(irqs []int) string {
+	strs := make([]string, 0, len(irqs))
+	for _, irq := range irqs {
+		strs = append(strs, strconv.Itoa(irq))
+	}
+	return strings.Join(strs, " ")
+}
+
+// send writes the command along with the credentials irqbalance requires and returns
+// the response, irqbalance handles a single command per connection.
+func (s *IRQBalanceSocket) send(command string) (string, error) {
+	socket, err := s.Path()
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialTimeout("unix", socket, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logrus.Warnf("error closing irqbalance socket %s: %v", socket, err)
+		}
+	}()
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return "", err
+	}
+	credentials := syscall.UnixCredentials(&syscall.Ucred{
+		Pid: int32(os.Getpid()),
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	})
+	if _, _, err := conn.(*net.UnixConn).WriteMsgUnix([]byte(command), credentials, nil); err != nil {
+		return "", err
+	}
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// fakeIRQBalance serves irqbalance control socket commands used by IRQBalanceSocket
+type fakeIRQBalance struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	banned     string
+	bannedIRQs []string
+	commands   []string
+}
+
+func startFakeIRQBalance(g *WithT, dir string) *fakeIRQBalance {
+	listener, err := net.Listen("unix", filepath.Join(dir, fmt.Sprintf("irqbalance%d.sock", os.Getpid())))
+	g.Expect(err).NotTo(HaveOccurred())
+	f := &fakeIRQBalance{listener: listener, banned: "00000001", bannedIRQs: []string{"27"}}
+	go f.serve()
+	return f
+}
+
+func (f *fakeIRQBalance) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 1024)
+		n, _ := conn.Read(buf)
+		command := string(buf[:n])
+
+		f.mu.Lock()
+		f.commands = append(f.commands, command)
+		if strings.HasPrefix(command, "settings cpus ") {
+			f.banned = "00000000"
+			if cpus := strings.TrimPrefix(command, "settings cpus "); cpus != "NULL" {
+				mask, _ := ParseCPUList(cpus)
+				f.banned = mask.String()
+			}
+		} else if strings.HasPrefix(command, "settings ban irqs ") {
+			f.bannedIRQs = nil
+			if irqs := strings.TrimPrefix(command, "settings ban irqs "); irqs != "NONE" {
+				f.bannedIRQs = strings.Fields(irqs)
+			}
+		} else if command == "setup" {
+			setup := "SLEEP 10 "
+			for _, irq := range f.bannedIRQs {
+				setup += "IRQ " + irq + " LOAD 0 DIFF 0 CLASS 2 "
+			}
+			_, _ = conn.Write([]byte(setup + "BANNED " + f.banned))
+		}
+		f.mu.Unlock()
+		_ = conn.Close()
+	}
+}
+
+func (f *fakeIRQBalance) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commands
+}
+
+func TestIRQBalanceSocketSetBannedCPUs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "irqbalance")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	fake := startFakeIRQBalance(g, dir)
+	defer fake.listener.Close()
+
+	socket := NewIRQBalanceSocket(dir)
+	banned, err := socket.BannedCPUs()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(banned).To(Equal("00000001"))
+
+	g.Expect(socket.SetBannedCPUs("00000000,00000006")).NotTo(HaveOccurred())
+	g.Expect(socket.SetBannedCPUs("00000000,00000000")).NotTo(HaveOccurred())
+	g.Expect(fake.Commands()).To(Equal([]string{"setup", "settings cpus 1-2", "setup", "settings cpus NULL", "setup"}))
+}
+
+func TestIRQBalanceSocketSetBannedIRQs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "irqbalance")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	fake := startFakeIRQBalance(g, dir)
+	defer fake.listener.Close()
+
+	socket := NewIRQBalanceSocket(dir)
+	irqs, err := socket.BannedIRQs()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(irqs).To(Equal([]int{27}))
+
+	g.Expect(socket.SetBannedIRQs([]int{41, 42})).NotTo(HaveOccurred())
+	irqs, err = socket.BannedIRQs()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(irqs).To(Equal([]int{41, 42}))
+	g.Expect(socket.SetBannedIRQs(nil)).NotTo(HaveOccurred())
+	g.Expect(fake.Commands()).To(Equal([]string{"setup", "settings ban irqs 41 42", "setup", "setup",
+		"settings ban irqs NONE", "setup"}))
+}
+
+func TestIRQBalanceSocketNotFound(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "irqbalance")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	// socket left behind by an irqbalance which is gone
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "irqbalance999999999.sock"), nil, 0644)).NotTo(HaveOccurred())
+
+	_, err = NewIRQBalanceSocket(dir).Path()
+	g.Expect(err).To(Equal(ErrIRQBalanceSocketNotFound))
+}
+
+func TestResetIRQBalanceThroughSocket(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, configFile := createIRQBalanceConfigFile(g, "IRQBALANCE_BANNED_CPUS=\"00000001\"\n")
+	defer os.RemoveAll(dir)
+	fake := startFakeIRQBalance(g, dir)
+	defer fake.listener.Close()
+
+	config := IRQBalanceConfig{File: configFile, SocketDir: dir}
+	g.Expect(ResetIRQBalance(config, "00000000,00000006")).NotTo(HaveOccurred())
+	g.Expect(fake.Commands()).To(Equal([]string{"settings cpus 1-2", "setup"}))
+
+	banned, err := RetrieveIRQBalanceBannedCPUs(config)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(banned).To(Equal("00000000,00000006"))
+}
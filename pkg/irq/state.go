@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// IrqSmpBalanceStateDir directory persisting irq-smp-balance state across restarts
+	IrqSmpBalanceStateDir = "/host/var/lib/irq-smp-balance"
+)
+
+// readStateFile decodes json content of the state file into v. A missing or
+// empty file leaves v untouched.
+func readStateFile(file string, v interface{}) error {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, v)
+}
+
+// writeStateFile encodes v as json into the state file. The content is written
+// into a temporary file first so that a crash never leaves a truncated state.
+func writeStateFile(file string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SysCPUDir directory containing cpu topology of the host, mounted at /host/sys
+const SysCPUDir = "/host/sys/devices/system/cpu"
+
+// CPUTopologyDir directory the mask computation reads cpu topology from, the daemon
+// running on the host reads it from its own sysfs
+var CPUTopologyDir = SysCPUDir
+
+// CPUTopology cpus known to the kernel
+type CPUTopology struct {
+	// Possible cpus which can ever be online, decides the width of kernel cpu masks
+	Possible CPUMask
+	// Present cpus physically there
+	Present CPUMask
+	// Online cpus currently scheduling tasks and handling irqs
+	Online CPUMask
+	// Isolated cpus isolated with isolcpus kernel parameter
+	Isolated CPUMask
+}
+
+// ReadCPUTopology reads cpu topology from given sysfs cpu directory
+func ReadCPUTopology(dir string) (*CPUTopology, error) {
+	topology := &CPUTopology{}
+	for name, mask := range map[string]*CPUMask{
+		"possible": &topology.Possible,
+		"present":  &topology.Present,
+		"online":   &topology.Online,
+		"isolated": &topology.Isolated,
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) && name == "isolated" {
+			// older kernels don't expose isolated cpus
+			*mask = NewCPUMask()
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if *mask, err = ParseCPUList(string(content)); err != nil {
+			return nil, fmt.Errorf("invalid %s cpus %q: %v", name, string(content), err)
+		}
+	}
+	return topology, nil
+}
+
+// Width returns number of cpus the kernel cpu masks hold
+func (t *CPUTopology) Width() int {
+	cpus := t.Possible.CPUSet().ToSlice()
+	if len(cpus) == 0 {
+		return 0
+	}
+	return cpus[len(cpus)-1] + 1
+}
+
+// Housekeeping returns the online cpus which are not isolated with isolcpus, the only
+// ones interrupts may be steered to
+func (t *CPUTopology) Housekeeping() CPUMask {
+	return t.Online.Difference(t.Isolated)
+}
+
+// ValidateCPUs returns error when any of given cpus isn't present
+func (t *CPUTopology) ValidateCPUs(cpus CPUMask) error {
+	if missing := cpus.Difference(t.Present); !missing.IsEmpty() {
+		return fmt.Errorf("cpus %s don't exist, present cpus are %s", missing.CPUList(), t.Present.CPUList())
+	}
+	return nil
+}
+
+// ThreadSiblings returns given cpus along with all their hyperthread siblings
+func ThreadSiblings(dir string, cpus CPUMask) (CPUMask, error) {
+	siblings := cpus
+	for _, cpu := range cpus.CPUSet().ToSlice() {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "cpu"+strconv.Itoa(cpu), "topology", "thread_siblings_list"))
+		if err != nil {
+			return cpus, err
+		}
+		cpuSiblings, err := ParseCPUList(string(content))
+		if err != nil {
+			return cpus, fmt.Errorf("invalid thread siblings of cpu %d %q: %v", cpu, string(content), err)
+		}
+		siblings = siblings.Union(cpuSiblings)
+	}
+	return siblings, nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func createCPUTopologyDir(g *WithT, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "cpu")
+	g.Expect(err).NotTo(HaveOccurred())
+	for name, cpus := range files {
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte(cpus+"\n"), 0644)).NotTo(HaveOccurred())
+	}
+	return dir
+}
+
+// setCPUTopology makes mask computation use given possible (and present) and online
+// cpus until returned func is called
+func setCPUTopology(g *WithT, possible, online string) func() {
+	dir := createCPUTopologyDir(g, map[string]string{
+		"possible": possible,
+		"present":  possible,
+		"online":   online,
+		"isolated": "",
+	})
+	topologyDir := CPUTopologyDir
+	CPUTopologyDir = dir
+	return func() {
+		CPUTopologyDir = topologyDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReadCPUTopology(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createCPUTopologyDir(g, map[string]string{
+		"possible": "0-71",
+		"present":  "0-7",
+		"online":   "0-3,5-7",
+		"isolated": "6-7",
+	})
+	defer os.RemoveAll(dir)
+
+	topology, err := ReadCPUTopology(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(topology.Possible.CPUList()).To(Equal("0-71"))
+	g.Expect(topology.Present.CPUList()).To(Equal("0-7"))
+	g.Expect(topology.Online.CPUList()).To(Equal("0-3,5-7"))
+	g.Expect(topology.Isolated.CPUList()).To(Equal("6-7"))
+	g.Expect(topology.Width()).To(Equal(72))
+
+	g.Expect(topology.ValidateCPUs(NewCPUMask(1, 2))).NotTo(HaveOccurred())
+	g.Expect(topology.ValidateCPUs(NewCPUMask(2, 8, 9))).To(MatchError("cpus 8-9 don't exist, present cpus are 0-7"))
+
+	g.Expect(os.Remove(filepath.Join(dir, "isolated"))).NotTo(HaveOccurred())
+	topology, err = ReadCPUTopology(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(topology.Isolated.IsEmpty()).To(BeTrue())
+}
+
+func TestBannedMaskExcludesOfflineCPUs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-71", "0-3,5-7")()
+
+	cpuMask, bannedCPUMask, err := UpdateIRQSmpAffinityMask("1-2", "000000,00000000,000000ef", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(cpuMask).To(Equal("00000000,00000000,000000e9"))
+	g.Expect(bannedCPUMask).To(Equal("00000000,00000000,00000006"))
+}
+
+func TestThreadSiblings(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := createCPUTopologyDir(g, map[string]string{})
+	defer os.RemoveAll(dir)
+	for cpu, siblings := range map[string]string{"cpu0": "0,4", "cpu1": "1,5", "cpu4": "0,4", "cpu5": "1,5"} {
+		g.Expect(os.MkdirAll(filepath.Join(dir, cpu, "topology"), 0755)).NotTo(HaveOccurred())
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, cpu, "topology", "thread_siblings_list"), []byte(siblings+"\n"), 0644)).
+			NotTo(HaveOccurred())
+	}
+
+	siblings, err := ThreadSiblings(dir, NewCPUMask(0, 1))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(siblings.CPUList()).To(Equal("0-1,4-5"))
+
+	_, err = ThreadSiblings(dir, NewCPUMask(2))
+	g.Expect(err).To(HaveOccurred())
+}
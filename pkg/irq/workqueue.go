@@ -0,0 +1,163 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SysWorkqueueDir directory containing unbound workqueues of the host
+	SysWorkqueueDir = "/host/sys/devices/virtual/workqueue"
+	// WorkqueueMaskStoreFile file containing original cpumasks of unbound workqueues
+	WorkqueueMaskStoreFile = IrqSmpBalanceStateDir + "/workqueue_masks"
+	// workqueueCPUMaskFileName global and per workqueue file containing the workqueue mask
+	workqueueCPUMaskFileName = "cpumask"
+)
+
+// WorkqueueMaskStore narrows the global and per workqueue cpumasks of unbound
+// workqueues to the housekeeping cpus, and keeps their original masks in a file
+// to restore them when no cpu is isolated anymore.
+type WorkqueueMaskStore struct {
+	mu   sync.Mutex
+	dir  string
+	file string
+	// Originals maps cpumask file relative to the workqueue directory, cpumask for
+	// the global one, to its mask before the first isolation
+	Originals map[string]string
+}
+
+// NewWorkqueueMaskStore returns workqueue mask store for the workqueues in dir backed
+// by given file, loading the original masks recorded by previous run if any.
+func NewWorkqueueMaskStore(dir, file string) (*WorkqueueMaskStore, error) {
+	s := &WorkqueueMaskStore{
+		dir:       dir,
+		file:      file,
+		Originals: make(map[string]string),
+	}
+	if err := readStateFile(file, &s.Originals); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Isolate removes given cpus from the global and per workqueue cpumasks. A mask which
+// would be left without cpu is left alone, and per workqueue masks which kernel
+// refuses to change (e.g. of ordered workqueues) are skipped. It returns the cpumask
+// files which were changed.
+func (s *WorkqueueMaskStore) Isolate(cpus string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(false, func(name, current string) (string, bool) {
+		newMask, _, err := UpdateIRQSmpAffinityMask(cpus, current, false)
+		if err != nil {
+			logrus.Warnf("error updating workqueue mask %s of %s: %v", current, name, err)
+			return "", false
+		}
+		if newmask, err := ParseCPUMask(newMask); err != nil || newmask.IsEmpty() {
+			logrus.Warnf("workqueue mask %s of %s has no cpu left without cpus %s, leaving it", current, name, cpus)
+			return "", false
+		}
+		return newMask, true
+	})
+}
+
+// Release adds given cpus back to the cpumasks which had them originally. When it's
+// the last release, i.e. no isolated cpu is left, every cpumask gets its original
+// mask back and the original masks are forgotten.
+func (s *WorkqueueMaskStore) Release(cpus string, last bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed, err := s.update(true, func(name, current string) (string, bool) {
+		original, ok := s.Originals[name]
+		if !ok {
+			return "", false
+		}
+		if last {
+			return original, true
+		}
+		originalmask, err := ParseCPUMask(original)
+		if err != nil {
+			return "", false
+		}
+		freedmask, err := ParseCPUList(cpus)
+		if err != nil {
+			return "", false
+		}
+		newMask, _, err := UpdateIRQSmpAffinityMask(originalmask.Intersection(freedmask).CPUList(), current, true)
+		if err != nil {
+			logrus.Warnf("error updating workqueue mask %s of %s: %v", current, name, err)
+			return "", false
+		}
+		return newMask, true
+	})
+	if err == nil && last {
+		s.Originals = make(map[string]string)
+		err = s.persist()
+	}
+	return changed, err
+}
+
+// update writes the mask returned by updateFn into every cpumask file and records the
+// original masks unless releasing, failures of the per workqueue files are only logged
+func (s *WorkqueueMaskStore) update(release bool, updateFn func(name, current string) (string, bool)) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*", workqueueCPUMaskFileName))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	files = append([]string{filepath.Join(s.dir, workqueueCPUMaskFileName)}, files...)
+
+	var changed []string
+	for i, file := range files {
+		name, _ := filepath.Rel(s.dir, file)
+		current, err := RetrieveCPUMask(file)
+		if err != nil {
+			if i == 0 {
+				return changed, err
+			}
+			continue
+		}
+		newMask, ok := updateFn(name, current)
+		if !ok || masksEqual(newMask, current) {
+			continue
+		}
+		if err := ioutil.WriteFile(file, []byte(newMask), 0o644); err != nil {
+			if i == 0 {
+				return changed, err
+			}
+			logrus.Debugf("workqueue mask of %s can't be changed to %s: %v", name, newMask, err)
+			continue
+		}
+		if _, ok := s.Originals[name]; !ok && !release {
+			s.Originals[name] = current
+		}
+		changed = append(changed, name)
+	}
+	return changed, s.persist()
+}
+
+func (s *WorkqueueMaskStore) persist() error {
+	return writeStateFile(s.file, s.Originals)
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package irq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestWorkqueueMaskStore(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-7", "0-7")()
+	dir := createNetDir(g, map[string]string{
+		"cpumask":           "ff",
+		"writeback/cpumask": "ff",
+		"scsi_tmf/cpumask":  "06",
+	})
+	defer os.RemoveAll(dir)
+	storeFile := filepath.Join(dir, "workqueue_masks")
+
+	store, err := NewWorkqueueMaskStore(dir, storeFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	changed, err := store.Isolate("1-2")
+	g.Expect(err).NotTo(HaveOccurred())
+	// scsi_tmf would be left without cpu
+	g.Expect(changed).To(Equal([]string{"cpumask", "writeback/cpumask"}))
+	g.Expect(readQueueMask(g, dir, "cpumask")).To(Equal("000000f9"))
+	g.Expect(readQueueMask(g, dir, "writeback/cpumask")).To(Equal("000000f9"))
+	g.Expect(readQueueMask(g, dir, "scsi_tmf/cpumask")).To(Equal("06"))
+
+	// original masks survive restart and further isolation keeps them
+	store, err = NewWorkqueueMaskStore(dir, storeFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.Isolate("3")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.Originals).To(Equal(map[string]string{"cpumask": "ff", "writeback/cpumask": "ff"}))
+
+	changed, err = store.Release("1-2", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(changed).To(Equal([]string{"cpumask", "writeback/cpumask"}))
+	g.Expect(readQueueMask(g, dir, "cpumask")).To(Equal("000000f7"))
+
+	_, err = store.Release("3", true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(readQueueMask(g, dir, "cpumask")).To(Equal("ff"))
+	g.Expect(readQueueMask(g, dir, "writeback/cpumask")).To(Equal("ff"))
+	g.Expect(store.Originals).To(BeEmpty())
+}
+
+func TestWorkqueueMaskStoreWithoutWorkqueues(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setCPUTopology(g, "0-7", "0-7")()
+	dir := createNetDir(g, nil)
+	defer os.RemoveAll(dir)
+
+	store, err := NewWorkqueueMaskStore(dir, filepath.Join(dir, "workqueue_masks"))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.Isolate("1")
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+}
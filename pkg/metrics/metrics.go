@@ -0,0 +1,127 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics defines the prometheus metrics exported by smpaffinity and
+// irqsmpdaemon, each binary updates the ones relevant to it.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Path http path the metrics are served on
+	Path = "/metrics"
+
+	namespace = "irq_smp_balance"
+
+	// OperationAdd pod add operation label value
+	OperationAdd = "add"
+	// OperationDelete pod delete operation label value
+	OperationDelete = "delete"
+	// OperationReconcile periodic reconcile operation label value
+	OperationReconcile = "reconcile"
+)
+
+var (
+	// IsolatedCPUs number of cpus isolated from interrupts
+	IsolatedCPUs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "isolated_cpus",
+		Help:      "Number of cpus isolated from interrupts.",
+	})
+	// PodsHandled pod add and delete events handled, by operation
+	PodsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pods_handled_total",
+		Help:      "Number of irq labeled pod add and delete events handled.",
+	}, []string{"operation"})
+	// PodOperationFailures pod add, delete and reconcile operations failed, by operation
+	PodOperationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pod_operation_failures_total",
+		Help:      "Number of irq labeled pod add, delete and reconcile operations failed to apply irq load balancing.",
+	}, []string{"operation"})
+	// IRQBalanceResetFailures failed irqbalance resets with new banned cpus
+	IRQBalanceResetFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "irqbalance_reset_failures_total",
+		Help:      "Number of failed irqbalance resets with new banned cpus.",
+	})
+	// IRQBalanceRestarts irqbalance restarts, by restart method and result
+	IRQBalanceRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "irqbalance_restarts_total",
+		Help:      "Number of irqbalance restarts by restart method and result.",
+	}, []string{"method", "result"})
+	// IRQBalanceRestartDuration irqbalance restart duration, by restart method
+	IRQBalanceRestartDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "irqbalance_restart_duration_seconds",
+		Help:      "Time taken by irqbalance restarts by restart method.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"method"})
+	// CheckpointReadErrors failed reads of the cpu manager checkpoint
+	CheckpointReadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checkpoint_read_errors_total",
+		Help:      "Number of failed cpu manager checkpoint reads.",
+	})
+	// IsolationLatency time from pod running to isolation of its cpus applied
+	IsolationLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pod_isolation_latency_seconds",
+		Help:      "Time from irq labeled pod running to isolation of its cpus applied.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	})
+	// DriftDivergences live irq mask settings found diverged from the desired state, by
+	// setting
+	DriftDivergences = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drift_divergences_total",
+		Help:      "Number of times irq mask settings were found diverged from the desired state by setting.",
+	}, []string{"setting"})
+	// InterruptRate interrupt rate of every isolated cpu, when leakage sampling is on
+	InterruptRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "isolated_cpu_interrupts_per_second",
+		Help:      "Interrupt rate of isolated cpus between the last two interrupt samples.",
+	}, []string{"cpu"})
+)
+
+func init() {
+	prometheus.MustRegister(IsolatedCPUs, PodsHandled, PodOperationFailures, IRQBalanceResetFailures,
+		IRQBalanceRestarts, IRQBalanceRestartDuration, CheckpointReadErrors, IsolationLatency, InterruptRate, DriftDivergences)
+}
+
+// Serve serves the metrics on given address in background, empty address serves none
+func Serve(address string) {
+	if address == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, promhttp.Handler())
+	go func() {
+		logrus.Infof("serving metrics on %s%s", address, Path)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logrus.Errorf("error serving metrics on %s: %v", address, err)
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020-2021 Nordix Foundation.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsLint(t *testing.T) {
+	g := NewGomegaWithT(t)
+	PodOperationFailures.WithLabelValues(OperationReconcile).Inc()
+	IRQBalanceRestarts.WithLabelValues("dbus", "success").Inc()
+	IRQBalanceRestartDuration.WithLabelValues("dbus").Observe(0.5)
+	InterruptRate.WithLabelValues("1").Set(10)
+	DriftDivergences.WithLabelValues("/proc/irq/default_smp_affinity").Inc()
+
+	for _, c := range []prometheus.Collector{IsolatedCPUs, PodsHandled, PodOperationFailures, IRQBalanceResetFailures,
+		IRQBalanceRestarts, IRQBalanceRestartDuration, CheckpointReadErrors, IsolationLatency, InterruptRate,
+		DriftDivergences} {
+		problems, err := testutil.CollectAndLint(c)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(problems).To(BeEmpty())
+	}
+	g.Expect(testutil.ToFloat64(PodOperationFailures.WithLabelValues(OperationReconcile))).To(Equal(1.0))
+}
+
+func TestServe(t *testing.T) {
+	g := NewGomegaWithT(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred())
+	address := listener.Addr().String()
+	g.Expect(listener.Close()).To(Succeed())
+
+	PodsHandled.WithLabelValues(OperationAdd).Inc()
+	Serve(address)
+	body := func() string {
+		resp, err := http.Get("http://" + address + Path)
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(resp.Body)
+		return string(content)
+	}
+	g.Eventually(body).Should(ContainSubstring(`irq_smp_balance_pods_handled_total{operation="add"} 1`))
+}